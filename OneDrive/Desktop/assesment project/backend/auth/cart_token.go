@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignCartToken returns a token that gives access to a guest cart until
+// expiresAt. The cart ID and expiry are readable; the HMAC stops anyone
+// from pointing a token at another cart.
+func SignCartToken(cartID uint, expiresAt time.Time, secret []byte) string {
+	payload := fmt.Sprintf("%d.%d", cartID, expiresAt.Unix())
+	return payload + "." + encoding.EncodeToString(cartTokenMAC(payload, secret))
+}
+
+// ParseCartToken verifies a token from SignCartToken and returns its cart ID.
+func ParseCartToken(token string, secret []byte, now time.Time) (uint, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalidToken
+	}
+
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(signature, cartTokenMAC(parts[0]+"."+parts[1], secret)) {
+		return 0, ErrInvalidToken
+	}
+
+	cartID, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	expiresAt, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidToken
+	}
+	if now.Unix() >= expiresAt {
+		return 0, ErrTokenExpired
+	}
+
+	return uint(cartID), nil
+}
+
+func cartTokenMAC(payload string, secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("cart:" + payload))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// Attempts is the failed-login state kept for one key (an account or an IP).
+type Attempts struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// AttemptStore keeps failed-login counters. MemoryAttemptStore is enough for
+// a single instance; several instances behind a load balancer need a shared
+// implementation (e.g. Redis) so they see each other's counters.
+type AttemptStore interface {
+	// Get returns the state for key, or the zero value if there is none.
+	Get(key string, now time.Time) (Attempts, error)
+	// RecordFailure atomically counts a failure for key and returns the new
+	// state. The state is forgotten ttl after the last failure.
+	RecordFailure(key string, now time.Time, ttl time.Duration) (Attempts, error)
+	// Lock blocks key until the given time.
+	Lock(key string, until time.Time) error
+	// Reset forgets key.
+	Reset(key string) error
+}
+
+type memoryEntry struct {
+	attempts  Attempts
+	expiresAt time.Time
+}
+
+// MemoryAttemptStore is an in-process AttemptStore.
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	entries map[string]*memoryEntry
+	writes  int
+}
+
+func NewMemoryAttemptStore() *MemoryAttemptStore {
+	return &MemoryAttemptStore{entries: make(map[string]*memoryEntry)}
+}
+
+func (s *MemoryAttemptStore) Get(key string, now time.Time) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entries[key]
+	if entry == nil || !now.Before(entry.expiresAt) {
+		return Attempts{}, nil
+	}
+	return entry.attempts, nil
+}
+
+func (s *MemoryAttemptStore) RecordFailure(key string, now time.Time, ttl time.Duration) (Attempts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writes++
+	if s.writes%1024 == 0 {
+		s.sweep(now)
+	}
+
+	entry := s.entries[key]
+	if entry == nil || !now.Before(entry.expiresAt) {
+		entry = &memoryEntry{}
+		s.entries[key] = entry
+	}
+	entry.attempts.Failures++
+	entry.attempts.LastFailure = now
+	if expiresAt := now.Add(ttl); expiresAt.After(entry.expiresAt) {
+		entry.expiresAt = expiresAt
+	}
+	return entry.attempts, nil
+}
+
+func (s *MemoryAttemptStore) Lock(key string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := s.entries[key]
+	if entry == nil {
+		entry = &memoryEntry{}
+		s.entries[key] = entry
+	}
+	entry.attempts.LockedUntil = until
+	if until.After(entry.expiresAt) {
+		entry.expiresAt = until
+	}
+	return nil
+}
+
+func (s *MemoryAttemptStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.entries, key)
+	return nil
+}
+
+// sweep drops expired entries so keys that are never retried do not pile up.
+func (s *MemoryAttemptStore) sweep(now time.Time) {
+	for key, entry := range s.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// AttemptPolicy decides how failures for one kind of key are throttled.
+type AttemptPolicy struct {
+	// Failures allowed before backoff starts
+	FreeAttempts int
+	// Delay after the first failure past FreeAttempts, doubled for each
+	// further failure and capped at BackoffMax
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Failures that lock the key for LockDuration; 0 never locks
+	LockThreshold int
+	LockDuration  time.Duration
+	// How long failures are remembered after the last one
+	Window time.Duration
+}
+
+func (p AttemptPolicy) wait(a Attempts, now time.Time) (time.Duration, bool) {
+	if now.Before(a.LockedUntil) {
+		return a.LockedUntil.Sub(now), true
+	}
+
+	excess := a.Failures - p.FreeAttempts
+	if excess <= 0 || p.BackoffBase <= 0 {
+		return 0, false
+	}
+
+	delay := p.BackoffMax
+	if excess <= 30 {
+		if backoff := p.BackoffBase << uint(excess-1); backoff > 0 && backoff < delay {
+			delay = backoff
+		}
+	}
+	if next := a.LastFailure.Add(delay); now.Before(next) {
+		return next.Sub(now), false
+	}
+	return 0, false
+}
+
+// LoginGuard throttles password logins per account and per client IP.
+// Accounts are locked after repeated failures; IPs only back off, so users
+// sharing an address (an office NAT) are slowed down rather than blocked.
+type LoginGuard struct {
+	Store   AttemptStore
+	Account AttemptPolicy
+	IP      AttemptPolicy
+	// Now returns the current time; tests replace it
+	Now func() time.Time
+}
+
+func accountKey(username string) string { return "account:" + username }
+func ipKey(ip string) string            { return "ip:" + ip }
+
+// Check reports how long a login for username from ip must wait. A zero
+// wait means the attempt may proceed; locked is true when the account is
+// locked rather than backing off.
+func (g *LoginGuard) Check(username, ip string) (wait time.Duration, locked bool, err error) {
+	now := g.Now()
+
+	account, err := g.Store.Get(accountKey(username), now)
+	if err != nil {
+		return 0, false, err
+	}
+	wait, locked = g.Account.wait(account, now)
+	if locked {
+		return wait, true, nil
+	}
+
+	client, err := g.Store.Get(ipKey(ip), now)
+	if err != nil {
+		return 0, false, err
+	}
+	if ipWait, _ := g.IP.wait(client, now); ipWait > wait {
+		wait = ipWait
+	}
+	return wait, false, nil
+}
+
+// Fail records a failed login. When this failure locks the account it
+// returns when the lock ends.
+func (g *LoginGuard) Fail(username, ip string) (lockedUntil time.Time, err error) {
+	now := g.Now()
+
+	if _, err := g.Store.RecordFailure(ipKey(ip), now, g.IP.Window); err != nil {
+		return time.Time{}, err
+	}
+
+	account, err := g.Store.RecordFailure(accountKey(username), now, g.Account.Window)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if g.Account.LockThreshold > 0 && account.Failures >= g.Account.LockThreshold {
+		lockedUntil = now.Add(g.Account.LockDuration)
+		if err := g.Store.Lock(accountKey(username), lockedUntil); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return lockedUntil, nil
+}
+
+// Succeed clears the account's failures after a successful login. The IP
+// counter is left alone so logging into one account does not reset the
+// backoff for guessing others.
+func (g *LoginGuard) Succeed(username string) error {
+	return g.Store.Reset(accountKey(username))
+}
+
+// Unlock clears an account's lock and failures.
+func (g *LoginGuard) Unlock(username string) error {
+	return g.Store.Reset(accountKey(username))
+}
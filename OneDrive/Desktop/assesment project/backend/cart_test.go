@@ -1,20 +1,33 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"shopping-cart/auth"
+	"shopping-cart/config"
 	"shopping-cart/database"
 	"shopping-cart/handlers"
+	"shopping-cart/mail"
 	"shopping-cart/middleware"
 	"shopping-cart/models"
 
 	"github.com/gin-gonic/gin"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/bcrypt"
 )
 
 func TestShoppingCart(t *testing.T) {
@@ -24,8 +37,8 @@ func TestShoppingCart(t *testing.T) {
 
 var _ = Describe("Shopping Cart API", func() {
 	var router *gin.Engine
-	var testUser models.User
 	var testToken string
+	var adminToken string
 
 	BeforeEach(func() {
 		gin.SetMode(gin.TestMode)
@@ -36,14 +49,8 @@ var _ = Describe("Shopping Cart API", func() {
 		database.SeedData()
 
 		// Setup routes
-		router.POST("/users", handlers.CreateUser)
-		router.POST("/users/login", handlers.Login)
-		router.POST("/items", handlers.CreateItem)
-		router.GET("/items", handlers.ListItems)
-		router.POST("/carts", middleware.AuthMiddleware(), handlers.CreateCart)
-		router.GET("/carts", middleware.AuthMiddleware(), handlers.ListCarts)
-		router.POST("/orders", middleware.AuthMiddleware(), handlers.CreateOrder)
-		router.GET("/orders", middleware.AuthMiddleware(), handlers.ListOrders)
+		registerRoutes(router)
+		handlers.LoginGuard = handlers.NewLoginGuard(config.Current)
 
 		// Create a test user
 		userReq := handlers.CreateUserRequest{
@@ -70,13 +77,19 @@ var _ = Describe("Shopping Cart API", func() {
 		var loginResp map[string]interface{}
 		json.Unmarshal(w.Body.Bytes(), &loginResp)
 		testToken = loginResp["token"].(string)
+
+		// Create an admin for the restricted endpoints
+		database.SeedAdmin("admin", "adminpass123")
+		w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "admin", Password: "adminpass123"}, "")
+		json.Unmarshal(w.Body.Bytes(), &loginResp)
+		adminToken = loginResp["token"].(string)
 	})
 
 	Describe("User Creation", func() {
 		It("should create a new user", func() {
 			userReq := handlers.CreateUserRequest{
 				Username: "newuser",
-				Password: "password123",
+				Password: "newuserpass42",
 			}
 			body, _ := json.Marshal(userReq)
 			req := httptest.NewRequest("POST", "/users", bytes.NewBuffer(body))
@@ -141,6 +154,207 @@ var _ = Describe("Shopping Cart API", func() {
 		})
 	})
 
+	Describe("Cart Item Validation", func() {
+		BeforeEach(func() {
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Update("status", "inactive")
+		})
+
+		It("should report the outcome of every requested item", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2, 3, 999}}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp handlers.CartResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Results).To(Equal([]handlers.CartItemResult{
+				{ItemID: 1, Status: handlers.CartItemAlreadyPresent, Quantity: 2},
+				{ItemID: 2, Status: handlers.CartItemAdded, Quantity: 1},
+				{ItemID: 3, Status: handlers.CartItemInactive},
+				{ItemID: 999, Status: handlers.CartItemNotFound},
+			}))
+			Expect(resp.CartItems).To(HaveLen(2))
+		})
+
+		It("should change nothing in strict mode when an item is rejected", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			w := performRequest(router, "POST", "/carts?strict=true", handlers.CreateCartRequest{ItemIDs: []uint{1, 2, 3}}, testToken)
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			var resp struct {
+				Results []handlers.CartItemResult `json:"results"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Results).To(HaveLen(3))
+			Expect(resp.Results[2].Status).To(Equal(handlers.CartItemInactive))
+
+			var cart models.Cart
+			json.Unmarshal(performRequest(router, "GET", "/carts/me", nil, testToken).Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.CartItems[0].Quantity).To(Equal(1))
+
+			w = performRequest(router, "POST", "/carts?strict=true", handlers.CreateCartRequest{ItemIDs: []uint{2}}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should not start a guest cart in strict mode when an item is rejected", func() {
+			var before int
+			database.DB.Model(&models.Cart{}).Count(&before)
+
+			w := performRequest(router, "POST", "/carts/guest?strict=true", handlers.CreateCartRequest{ItemIDs: []uint{999}}, "")
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+
+			var after int
+			database.DB.Model(&models.Cart{}).Count(&after)
+			Expect(after).To(Equal(before))
+		})
+	})
+
+	Describe("Cart Quantities", func() {
+		It("should increment the quantity when an item is added again", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(2))
+			Expect(cart.TotalQuantity).To(Equal(3))
+			for _, cartItem := range cart.CartItems {
+				if cartItem.ItemID == 1 {
+					Expect(cartItem.Quantity).To(Equal(2))
+				}
+			}
+		})
+
+		It("should set the quantity of a cart line", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{3}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/3", gin.H{"quantity": 5}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.CartItems[0].Quantity).To(Equal(5))
+			Expect(cart.TotalQuantity).To(Equal(5))
+		})
+
+		It("should remove the line when the quantity is set to zero", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 3}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/3", gin.H{"quantity": 0}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.CartItems[0].ItemID).To(Equal(uint(1)))
+		})
+
+		It("should reject a negative quantity", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": -1}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should reject a quantity above the maximum", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": models.MaxLineQuantity + 1}, testToken)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			w = performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": models.MaxLineQuantity}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			w = performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			var cartItem models.CartItem
+			database.DB.Where("item_id = ?", 1).First(&cartItem)
+			Expect(cartItem.Quantity).To(Equal(models.MaxLineQuantity))
+		})
+
+		It("should delete a cart line", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			w := performRequest(router, "DELETE", "/carts/me/items/2", nil, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.TotalQuantity).To(Equal(1))
+		})
+
+		It("should return not found for an item that is not in the cart", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "DELETE", "/carts/me/items/4", nil, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Pricing", func() {
+		It("should create an item with a price and currency", func() {
+			w := performRequest(router, "POST", "/items", handlers.CreateItemRequest{Name: "Webcam", Price: 3999, Currency: "eur"}, adminToken)
+
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var item models.Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+			Expect(item.Price).To(Equal(int64(3999)))
+			Expect(item.Currency).To(Equal("EUR"))
+		})
+
+		It("should reject an invalid currency", func() {
+			w := performRequest(router, "POST", "/items", handlers.CreateItemRequest{Name: "Webcam", Price: 3999, Currency: "EURO"}, adminToken)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should show line subtotals and the cart total", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2, 3}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/2", gin.H{"quantity": 3}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			for _, cartItem := range cart.CartItems {
+				if cartItem.ItemID == 2 {
+					Expect(*cartItem.Subtotal).To(Equal(models.NewMoney(7500, "USD")))
+				}
+			}
+			Expect(*cart.Total).To(Equal(models.NewMoney(12499, "USD")))
+		})
+
+		It("should refuse to mix currencies in one cart", func() {
+			w := performRequest(router, "POST", "/items", handlers.CreateItemRequest{Name: "Webcam", Price: 3999, Currency: "EUR"}, adminToken)
+			var item models.Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w = performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{item.ID}}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should record the total on the order", func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Total).To(Equal(models.NewMoney(102400, "USD")))
+		})
+
+		It("should format amounts in major units", func() {
+			Expect(models.NewMoney(12499, "USD").String()).To(Equal("124.99 USD"))
+			Expect(models.NewMoney(-5, "USD").String()).To(Equal("-0.05 USD"))
+			Expect(models.NewMoney(1500, "JPY").String()).To(Equal("1500 JPY"))
+			Expect(models.NewMoney(1500, "KWD").String()).To(Equal("1.500 KWD"))
+		})
+	})
+
 	Describe("Order Creation", func() {
 		It("should create an order from a cart", func() {
 			// First create a cart
@@ -174,5 +388,2295 @@ var _ = Describe("Shopping Cart API", func() {
 			Expect(order.CartID).To(Equal(cart.ID))
 		})
 	})
-})
 
+	Describe("Order Lines", func() {
+		It("should keep the checkout snapshot when items change later", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{3}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/3", gin.H{"quantity": 2}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Lines).To(HaveLen(1))
+
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Updates(map[string]interface{}{"name": "Mechanical Keyboard", "price": 12900})
+
+			w = performRequest(router, "GET", "/orders", nil, testToken)
+			var orders []models.Order
+			json.Unmarshal(w.Body.Bytes(), &orders)
+			Expect(orders).To(HaveLen(1))
+			line := orders[0].Lines[0]
+			Expect(line.ItemName).To(Equal("Keyboard"))
+			Expect(line.UnitPrice).To(Equal(models.NewMoney(4999, "USD")))
+			Expect(line.Quantity).To(Equal(2))
+			Expect(line.LineTotal).To(Equal(models.NewMoney(9998, "USD")))
+		})
+	})
+
+	Describe("Cart Revalidation", func() {
+		readCart := func() models.Cart {
+			w := performRequest(router, "GET", "/carts/me", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return cart
+		}
+
+		BeforeEach(func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2, 3}}, testToken)
+		})
+
+		It("should flag lines whose item changed since it was added", func() {
+			cart := readCart()
+			Expect(cart.Issues).To(BeEmpty())
+			Expect(cart.Version).NotTo(BeEmpty())
+
+			database.DB.Model(&models.Item{}).Where("id = ?", 2).Update("status", "inactive")
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Update("price", 5499)
+			database.DB.Exec("DELETE FROM items WHERE id = ?", 1)
+
+			changed := readCart()
+			Expect(changed.Version).NotTo(Equal(cart.Version))
+			added, current := models.NewMoney(4999, "USD"), models.NewMoney(5499, "USD")
+			Expect(changed.Issues).To(ConsistOf(
+				models.CartIssue{ItemID: 1, Issue: models.CartIssueRemoved},
+				models.CartIssue{ItemID: 2, Issue: models.CartIssueInactive},
+				models.CartIssue{ItemID: 3, Issue: models.CartIssuePriceChanged, AddedPrice: &added, CurrentPrice: &current},
+			))
+		})
+
+		It("should leave removed and inactive lines out of the total", func() {
+			database.DB.Model(&models.Item{}).Where("id = ?", 2).Update("status", "inactive")
+			database.DB.Exec("DELETE FROM items WHERE id = ?", 1)
+
+			cart := readCart()
+			Expect(cart.Total).NotTo(BeNil())
+			Expect(*cart.Total).To(Equal(models.NewMoney(4999, "USD")))
+			Expect(cart.TotalQuantity).To(Equal(1))
+
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID, CartVersion: cart.Version}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			Expect(order.Total).To(Equal(*cart.Total))
+		})
+
+		It("should accept the current price when the line is changed", func() {
+			database.DB.Model(&models.Item{}).Where("id IN (?)", []uint{1, 3}).Update("price", 5499)
+			Expect(readCart().Issues).To(HaveLen(2))
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			performRequest(router, "PATCH", "/carts/me/items/3", gin.H{"quantity": 2}, testToken)
+
+			cart := readCart()
+			Expect(cart.Issues).To(BeEmpty())
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should refuse checkout until the changes are acknowledged", func() {
+			cart := readCart()
+			database.DB.Model(&models.Item{}).Where("id = ?", 2).Update("status", "inactive")
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Update("price", 5499)
+
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			var resp struct {
+				Issues      []models.CartIssue `json:"issues"`
+				CartVersion string             `json:"cart_version"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Issues).To(HaveLen(2))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID, CartVersion: cart.Version}, testToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+
+			Expect(readCart().Version).To(Equal(resp.CartVersion))
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID, CartVersion: resp.CartVersion}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+			itemIDs := []uint{}
+			for _, line := range order.Lines {
+				itemIDs = append(itemIDs, line.ItemID)
+			}
+			Expect(itemIDs).To(ConsistOf(uint(1), uint(3)))
+			for _, line := range order.Lines {
+				if line.ItemID == 3 {
+					Expect(line.UnitPrice).To(Equal(models.NewMoney(5499, "USD")))
+				}
+			}
+		})
+
+		It("should refuse a stale version even without issues", func() {
+			cart := readCart()
+			performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 2}, testToken)
+
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID, CartVersion: cart.Version}, testToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID, CartVersion: readCart().Version}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("Order Lifecycle", func() {
+		var order models.Order
+
+		BeforeEach(func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			json.Unmarshal(w.Body.Bytes(), &order)
+		})
+
+		It("should start new orders as pending", func() {
+			Expect(order.Status).To(Equal(models.OrderStatusPending))
+		})
+
+		It("should move through legal transitions and record history", func() {
+			path := fmt.Sprintf("/orders/%d/transitions", order.ID)
+			for _, status := range []string{"paid", "fulfilled", "shipped", "delivered"} {
+				w := performRequest(router, "POST", path, handlers.TransitionOrderRequest{Status: status}, adminToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+			}
+
+			w := performRequest(router, "GET", fmt.Sprintf("/orders/%d/history", order.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var resp struct {
+				Status  string                   `json:"status"`
+				History []models.OrderTransition `json:"history"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Status).To(Equal(models.OrderStatusDelivered))
+			Expect(resp.History).To(HaveLen(5))
+			Expect(resp.History[0].FromStatus).To(BeEmpty())
+			Expect(resp.History[0].ToStatus).To(Equal(models.OrderStatusPending))
+			Expect(resp.History[4].FromStatus).To(Equal(models.OrderStatusShipped))
+			Expect(resp.History[4].ToStatus).To(Equal(models.OrderStatusDelivered))
+			Expect(resp.History[4].CreatedAt).ToNot(BeZero())
+		})
+
+		It("should reject an illegal transition with a conflict", func() {
+			w := performRequest(router, "POST", fmt.Sprintf("/orders/%d/transitions", order.ID), handlers.TransitionOrderRequest{Status: "shipped"}, adminToken)
+
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp["error"]).To(Equal("Cannot transition order from pending to shipped"))
+		})
+
+		It("should not leave a terminal status", func() {
+			path := fmt.Sprintf("/orders/%d/transitions", order.ID)
+			performRequest(router, "POST", path, handlers.TransitionOrderRequest{Status: "cancelled"}, adminToken)
+			w := performRequest(router, "POST", path, handlers.TransitionOrderRequest{Status: "paid"}, adminToken)
+
+			Expect(w.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("should reject an unknown status", func() {
+			w := performRequest(router, "POST", fmt.Sprintf("/orders/%d/transitions", order.ID), handlers.TransitionOrderRequest{Status: "lost"}, adminToken)
+
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("Concurrent Checkout", func() {
+		It("should create exactly one order when the same cart is checked out in parallel", func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			// The test database runs on a single connection, so the checkouts'
+			// transactions queue up behind each other instead of overlapping.
+			// This checks that the claim turns every checkout after the first
+			// into a conflict; that two overlapping transactions cannot both
+			// claim the cart rests on the conditional UPDATE and is only
+			// exercised against a database with several connections.
+			const attempts = 10
+			codes := make(chan int, attempts)
+			var wg sync.WaitGroup
+			for i := 0; i < attempts; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					codes <- performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken).Code
+				}()
+			}
+			wg.Wait()
+			close(codes)
+
+			created, conflicts := 0, 0
+			for code := range codes {
+				switch code {
+				case http.StatusCreated:
+					created++
+				case http.StatusConflict:
+					conflicts++
+				}
+			}
+			Expect(created).To(Equal(1))
+			Expect(conflicts).To(Equal(attempts - 1))
+
+			var count int
+			database.DB.Model(&models.Order{}).Where("cart_id = ?", cart.ID).Count(&count)
+			Expect(count).To(Equal(1))
+			database.DB.Model(&models.OrderLine{}).Count(&count)
+			Expect(count).To(Equal(2))
+		})
+
+		It("should reject checking out a cart twice", func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusConflict))
+		})
+	})
+
+	Describe("Idempotency Keys", func() {
+		var cart models.Cart
+
+		postWithKey := func(path string, payload interface{}, key string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(payload)
+			req := httptest.NewRequest("POST", path, bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+testToken)
+			req.Header.Set(middleware.IdempotencyKeyHeader, key)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		BeforeEach(func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			json.Unmarshal(w.Body.Bytes(), &cart)
+		})
+
+		It("should replay the first order response on retry", func() {
+			first := postWithKey("/orders", handlers.CreateOrderRequest{CartID: cart.ID}, "order-key-1")
+			second := postWithKey("/orders", handlers.CreateOrderRequest{CartID: cart.ID}, "order-key-1")
+
+			Expect(first.Code).To(Equal(http.StatusCreated))
+			Expect(second.Code).To(Equal(http.StatusCreated))
+			Expect(second.Body.Bytes()).To(Equal(first.Body.Bytes()))
+			Expect(second.Header().Get("Idempotent-Replayed")).To(Equal("true"))
+
+			var count int
+			database.DB.Model(&models.Order{}).Count(&count)
+			Expect(count).To(Equal(1))
+		})
+
+		It("should not add cart items twice on retry", func() {
+			postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, "cart-key-1")
+			w := postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, "cart-key-1")
+
+			var replayed models.Cart
+			json.Unmarshal(w.Body.Bytes(), &replayed)
+			Expect(replayed.TotalQuantity).To(Equal(2))
+
+			var cartItem models.CartItem
+			database.DB.Where("cart_id = ? AND item_id = ?", cart.ID, 1).First(&cartItem)
+			Expect(cartItem.Quantity).To(Equal(2))
+		})
+
+		It("should reject a different request reusing a key", func() {
+			postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, "cart-key-2")
+			w := postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, "cart-key-2")
+
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+		})
+
+		It("should reject a different query string reusing a key", func() {
+			postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, "cart-key-4")
+			w := postWithKey("/carts?strict=true", handlers.CreateCartRequest{ItemIDs: []uint{1}}, "cart-key-4")
+
+			Expect(w.Code).To(Equal(http.StatusUnprocessableEntity))
+			Expect(w.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+		})
+
+		It("should process the request again once the key has expired", func() {
+			postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, "cart-key-3")
+			database.DB.Model(&models.IdempotencyKey{}).Where("key = ?", "cart-key-3").Update("expires_at", time.Now().Add(-time.Minute))
+			w := postWithKey("/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, "cart-key-3")
+
+			Expect(w.Header().Get("Idempotent-Replayed")).To(BeEmpty())
+			var updated models.Cart
+			json.Unmarshal(w.Body.Bytes(), &updated)
+			Expect(updated.TotalQuantity).To(Equal(3))
+		})
+	})
+
+	Describe("Inventory", func() {
+		It("should decrement stock at checkout", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 4}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var item models.Item
+			database.DB.First(&item, 1)
+			Expect(*item.Stock).To(Equal(6))
+		})
+
+		It("should put stock back when an order is cancelled", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 4}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+
+			w = performRequest(router, "POST", fmt.Sprintf("/orders/%d/transitions", order.ID), handlers.TransitionOrderRequest{Status: "cancelled"}, adminToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var item models.Item
+			database.DB.First(&item, 1)
+			Expect(*item.Stock).To(Equal(10))
+		})
+
+		It("should warn when a cart line exceeds the available stock", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 11}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.StockWarnings).To(ConsistOf(models.StockShortage{ItemID: 1, ItemName: "Laptop", Requested: 11, Available: 10}))
+		})
+
+		It("should reject the order with a shortage report and leave stock untouched", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			performRequest(router, "PATCH", "/carts/me/items/2", gin.H{"quantity": 5}, testToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 12}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+
+			Expect(w.Code).To(Equal(http.StatusConflict))
+			var resp struct {
+				Shortages []models.StockShortage `json:"shortages"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Shortages).To(ConsistOf(models.StockShortage{ItemID: 1, ItemName: "Laptop", Requested: 12, Available: 10}))
+
+			var item models.Item
+			database.DB.First(&item, 2)
+			Expect(*item.Stock).To(Equal(100))
+			database.DB.First(&cart, cart.ID)
+			Expect(cart.Status).To(Equal(models.CartStatusActive))
+		})
+
+		It("should not limit items without a stock level", func() {
+			w := performRequest(router, "POST", "/items", handlers.CreateItemRequest{Name: "Gift Card", Price: 2500}, adminToken)
+			var item models.Item
+			json.Unmarshal(w.Body.Bytes(), &item)
+			Expect(item.Stock).To(BeNil())
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{item.ID}}, testToken)
+			w = performRequest(router, "PATCH", fmt.Sprintf("/carts/me/items/%d", item.ID), gin.H{"quantity": 500}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.StockWarnings).To(BeEmpty())
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+		})
+	})
+
+	Describe("Stock Holds", func() {
+		var otherToken string
+
+		BeforeEach(func() {
+			config.Current.StockHoldsEnabled = true
+			otherToken = createUserAndLogin(router, "otheruser", "otherpass123")
+		})
+
+		AfterEach(func() {
+			config.Current = config.Defaults()
+		})
+
+		It("should subtract active holds from available-to-sell", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 8}, testToken)
+
+			w := performRequest(router, "GET", "/items", nil, "")
+			var items []models.Item
+			json.Unmarshal(w.Body.Bytes(), &items)
+			Expect(*items[0].Stock).To(Equal(10))
+			Expect(*items[0].Available).To(Equal(2))
+		})
+
+		It("should keep held stock away from other carts until the hold expires", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 8}, testToken)
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, otherToken)
+			w := performRequest(router, "PATCH", "/carts/me/items/1", gin.H{"quantity": 3}, otherToken)
+			var otherCart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &otherCart)
+			Expect(otherCart.StockWarnings).To(ConsistOf(models.StockShortage{ItemID: 1, ItemName: "Laptop", Requested: 3, Available: 2}))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: otherCart.ID}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+
+			database.DB.Model(&models.StockHold{}).Update("expires_at", time.Now().Add(-time.Minute))
+			database.ReleaseExpiredStockHolds()
+
+			var count int
+			database.DB.Model(&models.StockHold{}).Count(&count)
+			Expect(count).To(Equal(0))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: otherCart.ID}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should turn the hold into a stock decrement at checkout", func() {
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 1}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+
+			var hold models.StockHold
+			database.DB.Where("cart_id = ? AND item_id = ?", cart.ID, 1).First(&hold)
+			Expect(hold.Quantity).To(Equal(2))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var count int
+			database.DB.Model(&models.StockHold{}).Where("cart_id = ?", cart.ID).Count(&count)
+			Expect(count).To(Equal(0))
+			var item models.Item
+			database.DB.First(&item, 1)
+			Expect(*item.Stock).To(Equal(8))
+		})
+
+		It("should release the hold when the line is removed", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, testToken)
+			performRequest(router, "DELETE", "/carts/me/items/2", nil, testToken)
+
+			var count int
+			database.DB.Model(&models.StockHold{}).Count(&count)
+			Expect(count).To(Equal(0))
+		})
+	})
+
+	Describe("Sessions", func() {
+		login := func() string {
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+			var loginResp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &loginResp)
+			return loginResp["token"].(string)
+		}
+
+		It("should keep earlier sessions valid after a new login", func() {
+			secondToken := login()
+
+			Expect(performRequest(router, "GET", "/carts", nil, testToken).Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", "/carts", nil, secondToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should invalidate only the current session on logout", func() {
+			secondToken := login()
+
+			w := performRequest(router, "POST", "/users/logout", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			Expect(performRequest(router, "GET", "/carts", nil, testToken).Code).To(Equal(http.StatusUnauthorized))
+			Expect(performRequest(router, "GET", "/carts", nil, secondToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should store only a digest of the token", func() {
+			var session models.Session
+			database.DB.First(&session)
+
+			Expect(session.TokenHash).ToNot(Equal(testToken))
+			Expect(session.TokenHash).To(Equal(models.HashSessionToken(testToken)))
+
+			var count int
+			database.DB.Model(&models.Session{}).Where("token_hash = ?", testToken).Count(&count)
+			Expect(count).To(Equal(0))
+		})
+
+		It("should reject an expired session", func() {
+			database.DB.Model(&models.Session{}).Update("expires_at", time.Now().Add(-time.Minute))
+
+			w := performRequest(router, "GET", "/carts", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should list sessions and mark the current one", func() {
+			login()
+
+			w := performRequest(router, "GET", "/users/me/sessions", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var sessions []models.Session
+			json.Unmarshal(w.Body.Bytes(), &sessions)
+			Expect(sessions).To(HaveLen(2))
+			current := 0
+			for _, session := range sessions {
+				if session.Current {
+					current++
+				}
+				Expect(session.ExpiresAt).To(BeTemporally(">", time.Now()))
+			}
+			Expect(current).To(Equal(1))
+		})
+
+		It("should revoke another session by id", func() {
+			secondToken := login()
+			var session models.Session
+			database.DB.Order("id DESC").First(&session)
+
+			w := performRequest(router, "DELETE", fmt.Sprintf("/users/me/sessions/%d", session.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", "/carts", nil, secondToken).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not revoke another user's session", func() {
+			createUserAndLogin(router, "otheruser", "otherpass123")
+			var session models.Session
+			database.DB.Order("id DESC").First(&session)
+
+			w := performRequest(router, "DELETE", fmt.Sprintf("/users/me/sessions/%d", session.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusNotFound))
+		})
+	})
+
+	Describe("Access Control", func() {
+		var otherToken string
+		var staffToken string
+
+		BeforeEach(func() {
+			otherToken = createUserAndLogin(router, "otheruser", "otherpass123")
+			staffToken = createUserAndLogin(router, "staffuser", "staffpass123")
+			database.DB.Model(&models.User{}).Where("username = ?", "staffuser").Update("role", models.RoleStaff)
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, otherToken)
+		})
+
+		It("should register new users as customers", func() {
+			var user models.User
+			database.DB.Where("username = ?", "testuser").First(&user)
+			Expect(user.Role).To(Equal(models.RoleCustomer))
+		})
+
+		It("should restrict listing users to staff", func() {
+			Expect(performRequest(router, "GET", "/users", nil, "").Code).To(Equal(http.StatusUnauthorized))
+			Expect(performRequest(router, "GET", "/users", nil, testToken).Code).To(Equal(http.StatusForbidden))
+			Expect(performRequest(router, "GET", "/users", nil, staffToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should restrict item creation to admins", func() {
+			item := handlers.CreateItemRequest{Name: "Webcam", Price: 3999}
+			Expect(performRequest(router, "POST", "/items", item, testToken).Code).To(Equal(http.StatusForbidden))
+			Expect(performRequest(router, "POST", "/items", item, staffToken).Code).To(Equal(http.StatusForbidden))
+			Expect(performRequest(router, "POST", "/items", item, adminToken).Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should only show customers their own carts, even with ?user_id=", func() {
+			var other models.User
+			database.DB.Where("username = ?", "otheruser").First(&other)
+
+			w := performRequest(router, "GET", fmt.Sprintf("/carts?user_id=%d", other.ID), nil, testToken)
+			var carts []models.Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts).To(HaveLen(1))
+			Expect(carts[0].UserID).ToNot(Equal(other.ID))
+
+			w = performRequest(router, "GET", "/carts", nil, staffToken)
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts).To(HaveLen(2))
+
+			w = performRequest(router, "GET", fmt.Sprintf("/carts?user_id=%d", other.ID), nil, staffToken)
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts).To(HaveLen(1))
+			Expect(carts[0].UserID).To(Equal(other.ID))
+		})
+
+		It("should only show customers their own orders and history", func() {
+			var other models.User
+			database.DB.Where("username = ?", "otheruser").First(&other)
+			var otherCart models.Cart
+			database.DB.Where("user_id = ?", other.ID).First(&otherCart)
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: otherCart.ID}, otherToken)
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+
+			w = performRequest(router, "GET", fmt.Sprintf("/orders?user_id=%d", other.ID), nil, testToken)
+			var orders []models.Order
+			json.Unmarshal(w.Body.Bytes(), &orders)
+			Expect(orders).To(BeEmpty())
+
+			Expect(performRequest(router, "GET", fmt.Sprintf("/orders/%d/history", order.ID), nil, testToken).Code).To(Equal(http.StatusNotFound))
+			Expect(performRequest(router, "GET", fmt.Sprintf("/orders/%d/history", order.ID), nil, otherToken).Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", fmt.Sprintf("/orders/%d/history", order.ID), nil, staffToken).Code).To(Equal(http.StatusOK))
+
+			w = performRequest(router, "GET", "/orders", nil, staffToken)
+			json.Unmarshal(w.Body.Bytes(), &orders)
+			Expect(orders).To(HaveLen(1))
+		})
+
+		It("should restrict order transitions to staff", func() {
+			w := performRequest(router, "GET", "/carts/me", nil, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			var order models.Order
+			json.Unmarshal(w.Body.Bytes(), &order)
+
+			path := fmt.Sprintf("/orders/%d/transitions", order.ID)
+			Expect(performRequest(router, "POST", path, handlers.TransitionOrderRequest{Status: "paid"}, testToken).Code).To(Equal(http.StatusForbidden))
+			Expect(performRequest(router, "POST", path, handlers.TransitionOrderRequest{Status: "paid"}, staffToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should let admins change roles", func() {
+			var user models.User
+			database.DB.Where("username = ?", "otheruser").First(&user)
+			path := fmt.Sprintf("/users/%d/role", user.ID)
+
+			Expect(performRequest(router, "PUT", path, handlers.UpdateUserRoleRequest{Role: models.RoleStaff}, staffToken).Code).To(Equal(http.StatusForbidden))
+			Expect(performRequest(router, "PUT", path, handlers.UpdateUserRoleRequest{Role: "owner"}, adminToken).Code).To(Equal(http.StatusBadRequest))
+
+			w := performRequest(router, "PUT", path, handlers.UpdateUserRoleRequest{Role: models.RoleStaff}, adminToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", "/users", nil, otherToken).Code).To(Equal(http.StatusOK))
+		})
+	})
+
+	Describe("JWT Mode", func() {
+		var loginResp map[string]interface{}
+
+		BeforeEach(func() {
+			config.Current.AuthMode = config.AuthModeJWT
+			config.Current.JWTSecret = []byte("0123456789abcdef0123456789abcdef")
+
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &loginResp)
+		})
+
+		AfterEach(func() {
+			config.Current = config.Defaults()
+		})
+
+		refresh := func(refreshToken string) (*httptest.ResponseRecorder, map[string]interface{}) {
+			w := performRequest(router, "POST", "/users/token/refresh", handlers.RefreshTokenRequest{RefreshToken: refreshToken}, "")
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w, resp
+		}
+
+		It("should issue an access token and a refresh token at login", func() {
+			Expect(loginResp["token_type"]).To(Equal("Bearer"))
+			Expect(strings.Count(loginResp["token"].(string), ".")).To(Equal(2))
+			Expect(loginResp["refresh_token"]).ToNot(BeEmpty())
+		})
+
+		It("should authenticate with the access token without a session lookup", func() {
+			accessToken := loginResp["token"].(string)
+			database.DB.Delete(&models.Session{})
+
+			Expect(performRequest(router, "GET", "/orders", nil, accessToken).Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, accessToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should reject a tampered or expired access token", func() {
+			accessToken := loginResp["token"].(string)
+			Expect(performRequest(router, "GET", "/orders", nil, accessToken+"x").Code).To(Equal(http.StatusUnauthorized))
+
+			config.Current.AccessTokenTTL = -time.Minute
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+			json.Unmarshal(w.Body.Bytes(), &loginResp)
+			Expect(performRequest(router, "GET", "/orders", nil, loginResp["token"].(string)).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not accept opaque session tokens", func() {
+			Expect(performRequest(router, "GET", "/orders", nil, loginResp["refresh_token"].(string)).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should rotate the refresh token", func() {
+			w, resp := refresh(loginResp["refresh_token"].(string))
+
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(resp["refresh_token"]).ToNot(Equal(loginResp["refresh_token"]))
+			Expect(performRequest(router, "GET", "/orders", nil, resp["token"].(string)).Code).To(Equal(http.StatusOK))
+
+			w, _ = refresh(resp["refresh_token"].(string))
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should revoke the session when a rotated refresh token is reused", func() {
+			_, rotated := refresh(loginResp["refresh_token"].(string))
+
+			w, _ := refresh(loginResp["refresh_token"].(string))
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+			w, _ = refresh(rotated["refresh_token"].(string))
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should stop refreshing after logout", func() {
+			performRequest(router, "POST", "/users/logout", nil, loginResp["token"].(string))
+
+			w, _ := refresh(loginResp["refresh_token"].(string))
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+	Describe("Password Reset", func() {
+		var outbox *mail.OutboxMailer
+
+		BeforeEach(func() {
+			dir, err := os.MkdirTemp("", "outbox")
+			Expect(err).ToNot(HaveOccurred())
+			outbox = &mail.OutboxMailer{Dir: dir}
+			handlers.Mailer = outbox
+
+			performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "resetuser", Password: "oldpass123", Email: "reset@example.com"}, "")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(outbox.Dir)
+		})
+
+		lastResetToken := func() string {
+			paths, err := outbox.Messages()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(paths).ToNot(BeEmpty())
+
+			body, err := os.ReadFile(paths[len(paths)-1])
+			Expect(err).ToNot(HaveOccurred())
+			match := regexp.MustCompile(`Reset token: (\S+)`).FindSubmatch(body)
+			Expect(match).ToNot(BeNil())
+			return string(match[1])
+		}
+
+		It("should reject an invalid email at signup", func() {
+			w := performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "bademail", Password: "newuserpass42", Email: "not-an-email"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			w = performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "dupemail", Password: "newuserpass42", Email: "reset@example.com"}, "")
+			Expect(w.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("should answer the same way for unknown accounts", func() {
+			w := performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "nobody"}, "")
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+
+			paths, _ := outbox.Messages()
+			Expect(paths).To(BeEmpty())
+		})
+
+		It("should mail a token that resets the password and ends all sessions", func() {
+			oldToken := createUserAndLogin(router, "resetuser", "oldpass123")
+
+			w := performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Email: "reset@example.com"}, "")
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+			Expect(performRequest(router, "GET", "/orders", nil, oldToken).Code).To(Equal(http.StatusUnauthorized))
+
+			token := lastResetToken()
+			w = performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: token, NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "resetuser", Password: "oldpass123"}, "")
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "resetuser", Password: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should revoke sessions created before the reset", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			token := lastResetToken()
+
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "resetuser", Password: "oldpass123"}, "")
+			var loginResp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &loginResp)
+			sessionToken := loginResp["token"].(string)
+
+			performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: token, NewPassword: "newpass456"}, "")
+			Expect(performRequest(router, "GET", "/orders", nil, sessionToken).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should accept a token only once", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			token := lastResetToken()
+
+			w := performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: token, NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			w = performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: token, NewPassword: "other789"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should invalidate older tokens when a new one is issued", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			first := lastResetToken()
+			database.DB.Model(&models.PasswordResetToken{}).Update("created_at", time.Now().Add(-config.Current.PasswordResetCooldown))
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+
+			w := performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: first, NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			w = performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: lastResetToken(), NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should not issue another token or end new sessions during the cooldown", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			first := lastResetToken()
+			sessionToken := createUserAndLogin(router, "resetuser", "oldpass123")
+
+			w := performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+			Expect(performRequest(router, "GET", "/orders", nil, sessionToken).Code).To(Equal(http.StatusOK))
+			paths, _ := outbox.Messages()
+			Expect(paths).To(HaveLen(1))
+
+			w = performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: first, NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+		})
+
+		It("should apply the password policy to the new password", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+
+			w := performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: lastResetToken(), NewPassword: "qwerty123"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(w.Body.String()).To(ContainSubstring(`"new_password":["is too common"]`))
+		})
+
+		It("should reject an expired token", func() {
+			performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			token := lastResetToken()
+			database.DB.Model(&models.PasswordResetToken{}).Update("expires_at", time.Now().Add(-time.Minute))
+
+			w := performRequest(router, "POST", "/users/password/reset", handlers.ResetPasswordRequest{Token: token, NewPassword: "newpass456"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should deliver through SMTP", func() {
+			addr, received := startFakeSMTPServer()
+			handlers.Mailer = &mail.SMTPMailer{Addr: addr, From: "shop@example.com"}
+
+			w := performRequest(router, "POST", "/users/password/forgot", handlers.ForgotPasswordRequest{Username: "resetuser"}, "")
+			Expect(w.Code).To(Equal(http.StatusAccepted))
+
+			var data string
+			Eventually(received, time.Second).Should(Receive(&data))
+			Expect(data).To(ContainSubstring("To: reset@example.com"))
+			Expect(data).To(ContainSubstring("Reset token: "))
+		})
+	})
+	Describe("Login Throttling", func() {
+		var now time.Time
+
+		BeforeEach(func() {
+			now = time.Now()
+			handlers.LoginGuard.Now = func() time.Time { return now }
+		})
+
+		login := func(username, password string) *httptest.ResponseRecorder {
+			return performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: username, Password: password}, "")
+		}
+
+		It("should back off exponentially after the free attempts", func() {
+			for i := 0; i < config.Current.LoginFreeAttempts+1; i++ {
+				Expect(login("testuser", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+			}
+
+			w := login("testuser", "testpass123")
+			Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(w.Header().Get("Retry-After")).To(Equal("1"))
+
+			now = now.Add(time.Second)
+			Expect(login("testuser", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+
+			w = login("testuser", "testpass123")
+			Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(w.Header().Get("Retry-After")).To(Equal("2"))
+
+			now = now.Add(2 * time.Second)
+			Expect(login("testuser", "testpass123").Code).To(Equal(http.StatusOK))
+		})
+
+		It("should throttle unknown usernames the same way", func() {
+			for i := 0; i < config.Current.LoginFreeAttempts+1; i++ {
+				Expect(login("nobody", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+			}
+			Expect(login("nobody", "wrongpass").Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		It("should back off per IP across usernames", func() {
+			handlers.LoginGuard.IP.FreeAttempts = 2
+
+			Expect(login("first", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+			Expect(login("second", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+			Expect(login("third", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+			Expect(login("testuser", "testpass123").Code).To(Equal(http.StatusTooManyRequests))
+		})
+
+		Context("when the lockout threshold is reached", func() {
+			BeforeEach(func() {
+				handlers.LoginGuard.Account.BackoffBase = 0
+				handlers.LoginGuard.Account.LockThreshold = 3
+
+				Expect(login("testuser", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+				Expect(login("testuser", "wrongpass").Code).To(Equal(http.StatusUnauthorized))
+				Expect(login("testuser", "wrongpass").Code).To(Equal(http.StatusTooManyRequests))
+			})
+
+			It("should lock the account even for the right password", func() {
+				w := login("testuser", "testpass123")
+				Expect(w.Code).To(Equal(http.StatusTooManyRequests))
+				Expect(w.Header().Get("Retry-After")).To(Equal(fmt.Sprint(int(config.Current.LoginLockoutDuration.Seconds()))))
+			})
+
+			It("should unlock after the lockout duration", func() {
+				now = now.Add(config.Current.LoginLockoutDuration)
+				Expect(login("testuser", "testpass123").Code).To(Equal(http.StatusOK))
+			})
+
+			It("should let admins unlock the account", func() {
+				var user models.User
+				database.DB.Where("username = ?", "testuser").First(&user)
+				path := fmt.Sprintf("/users/%d/unlock", user.ID)
+
+				Expect(performRequest(router, "POST", path, nil, testToken).Code).To(Equal(http.StatusForbidden))
+				Expect(performRequest(router, "POST", path, nil, adminToken).Code).To(Equal(http.StatusOK))
+				Expect(login("testuser", "testpass123").Code).To(Equal(http.StatusOK))
+			})
+		})
+	})
+	Describe("Password Policy", func() {
+		fieldErrors := func(w *httptest.ResponseRecorder, field string) []interface{} {
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			fields, _ := resp["fields"].(map[string]interface{})
+			problems, _ := fields[field].([]interface{})
+			return problems
+		}
+
+		It("should reject short passwords", func() {
+			w := performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "shorty", Password: "abc12"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(fieldErrors(w, "password")).To(ContainElement("must be at least 8 characters"))
+		})
+
+		It("should reject common passwords regardless of case", func() {
+			w := performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "common", Password: "Password123"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(fieldErrors(w, "password")).To(ContainElement("is too common"))
+		})
+
+		It("should reject the username as password", func() {
+			w := performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "samesame99", Password: "SameSame99"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(fieldErrors(w, "password")).To(ConsistOf("must not be the same as the username"))
+		})
+
+		It("should apply the configured minimum length", func() {
+			config.Current.PasswordMinLength = 16
+			defer func() { config.Current = config.Defaults() }()
+
+			w := performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: "longer", Password: "fifteen-chars!!"}, "")
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+			Expect(fieldErrors(w, "password")).To(ConsistOf("must be at least 16 characters"))
+		})
+
+	})
+
+	Describe("Password Hash Upgrade", func() {
+		storedHash := func() string {
+			var user models.User
+			database.DB.Where("username = ?", "testuser").First(&user)
+			return user.Password
+		}
+
+		login := func() int {
+			return performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "").Code
+		}
+
+		AfterEach(func() {
+			config.Current = config.Defaults()
+		})
+
+		It("should keep hashes that use the current settings", func() {
+			before := storedHash()
+			Expect(login()).To(Equal(http.StatusOK))
+			Expect(storedHash()).To(Equal(before))
+		})
+
+		It("should rehash with a changed bcrypt cost", func() {
+			config.Current.BcryptCost = 4
+			Expect(login()).To(Equal(http.StatusOK))
+
+			cost, err := bcrypt.Cost([]byte(storedHash()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cost).To(Equal(4))
+		})
+
+		It("should move to argon2id and back", func() {
+			config.Current.PasswordHasher = auth.HashArgon2id
+			Expect(login()).To(Equal(http.StatusOK))
+			Expect(storedHash()).To(HavePrefix("$argon2id$"))
+			Expect(login()).To(Equal(http.StatusOK))
+
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "wrongpass"}, "")
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+			config.Current.PasswordHasher = auth.HashBcrypt
+			Expect(login()).To(Equal(http.StatusOK))
+			Expect(storedHash()).To(HavePrefix("$2a$"))
+		})
+	})
+	Describe("Two-Factor Authentication", func() {
+		var now time.Time
+		var secret string
+		var recoveryCodes []string
+
+		BeforeEach(func() {
+			now = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+			handlers.SetTOTPClock(func() time.Time { return now })
+		})
+
+		AfterEach(func() {
+			handlers.SetTOTPClock(time.Now)
+		})
+
+		codeAt := func(t time.Time) string {
+			code, err := auth.TOTPCode(secret, auth.TOTPStep(t))
+			Expect(err).ToNot(HaveOccurred())
+			return code
+		}
+
+		enroll := func() {
+			w := performRequest(router, "POST", "/users/me/2fa/enroll", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			secret = resp["secret"].(string)
+
+			w = performRequest(router, "POST", "/users/me/2fa/verify", handlers.TwoFactorCodeRequest{Code: codeAt(now)}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var verifyResp struct {
+				RecoveryCodes []string `json:"recovery_codes"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &verifyResp)
+			recoveryCodes = verifyResp.RecoveryCodes
+		}
+
+		startLogin := func() string {
+			w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp["two_factor_required"]).To(BeTrue())
+			Expect(resp).ToNot(HaveKey("token"))
+			return resp["challenge_token"].(string)
+		}
+
+		secondStep := func(challenge, code string) *httptest.ResponseRecorder {
+			return performRequest(router, "POST", "/users/login/2fa", handlers.TwoFactorLoginRequest{ChallengeToken: challenge, Code: code}, "")
+		}
+
+		It("should compute the RFC 6238 test vectors", func() {
+			secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+			Expect(codeAt(time.Unix(59, 0))).To(Equal("287082"))
+			Expect(codeAt(time.Unix(1111111109, 0))).To(Equal("081804"))
+			Expect(codeAt(time.Unix(1234567890, 0))).To(Equal("005924"))
+			Expect(codeAt(time.Unix(2000000000, 0))).To(Equal("279037"))
+		})
+
+		It("should return a secret and an otpauth URI", func() {
+			w := performRequest(router, "POST", "/users/me/2fa/enroll", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp map[string]string
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp["otpauth_uri"]).To(HavePrefix("otpauth://totp/Shopping%20Cart:testuser?"))
+			Expect(resp["otpauth_uri"]).To(ContainSubstring("secret=" + resp["secret"]))
+		})
+
+		It("should not enable two-factor authentication before a valid code", func() {
+			performRequest(router, "POST", "/users/me/2fa/enroll", nil, testToken)
+
+			w := performRequest(router, "POST", "/users/me/2fa/verify", handlers.TwoFactorCodeRequest{Code: "000000"}, testToken)
+			Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+			w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+			Expect(w.Body.String()).To(ContainSubstring(`"token"`))
+		})
+
+		Context("once enrolled", func() {
+			BeforeEach(func() {
+				enroll()
+				Expect(recoveryCodes).To(HaveLen(10))
+			})
+
+			It("should refuse to enrol again", func() {
+				Expect(performRequest(router, "POST", "/users/me/2fa/enroll", nil, testToken).Code).To(Equal(http.StatusConflict))
+			})
+
+			It("should require a TOTP code after the password", func() {
+				now = now.Add(30 * time.Second)
+				w := secondStep(startLogin(), codeAt(now))
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				var resp map[string]interface{}
+				json.Unmarshal(w.Body.Bytes(), &resp)
+				Expect(performRequest(router, "GET", "/orders", nil, resp["token"].(string)).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should accept a code from the neighbouring time step", func() {
+				now = now.Add(60 * time.Second)
+				Expect(secondStep(startLogin(), codeAt(now.Add(-30*time.Second))).Code).To(Equal(http.StatusOK))
+			})
+
+			It("should not accept a code twice", func() {
+				Expect(secondStep(startLogin(), codeAt(now)).Code).To(Equal(http.StatusUnauthorized))
+
+				now = now.Add(30 * time.Second)
+				code := codeAt(now)
+				Expect(secondStep(startLogin(), code).Code).To(Equal(http.StatusOK))
+				Expect(secondStep(startLogin(), code).Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should accept each recovery code once", func() {
+				Expect(secondStep(startLogin(), strings.ToUpper(recoveryCodes[0])).Code).To(Equal(http.StatusOK))
+				Expect(secondStep(startLogin(), recoveryCodes[0]).Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should reject an expired challenge", func() {
+				challenge := startLogin()
+				now = now.Add(config.Current.TwoFactorChallengeTTL + time.Minute)
+				Expect(secondStep(challenge, codeAt(now)).Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should discard a challenge after too many wrong codes", func() {
+				handlers.LoginGuard.Account.BackoffBase = 0
+				handlers.LoginGuard.IP.BackoffBase = 0
+
+				challenge := startLogin()
+				for i := 0; i < 5; i++ {
+					Expect(secondStep(challenge, "000000").Code).To(Equal(http.StatusUnauthorized))
+				}
+
+				now = now.Add(30 * time.Second)
+				w := secondStep(challenge, codeAt(now))
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+				Expect(w.Body.String()).To(ContainSubstring("Invalid or expired challenge"))
+			})
+
+			It("should turn off with a valid code", func() {
+				Expect(performRequest(router, "DELETE", "/users/me/2fa", handlers.TwoFactorCodeRequest{Code: "000000"}, testToken).Code).To(Equal(http.StatusUnauthorized))
+				Expect(performRequest(router, "DELETE", "/users/me/2fa", handlers.TwoFactorCodeRequest{Code: recoveryCodes[1]}, testToken).Code).To(Equal(http.StatusOK))
+
+				w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+				Expect(w.Body.String()).To(ContainSubstring(`"token"`))
+			})
+		})
+	})
+	Describe("Profile", func() {
+		It("should return the current user", func() {
+			w := performRequest(router, "GET", "/users/me", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var user map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &user)
+			Expect(user["username"]).To(Equal("testuser"))
+			Expect(user).ToNot(HaveKey("password"))
+		})
+
+		It("should update the username and display fields", func() {
+			w := performRequest(router, "PATCH", "/users/me", map[string]string{"username": "renamed", "display_name": "Test User", "email": "me@example.com"}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var user models.User
+			json.Unmarshal(w.Body.Bytes(), &user)
+			Expect(user.Username).To(Equal("renamed"))
+			Expect(user.DisplayName).To(Equal("Test User"))
+			Expect(*user.Email).To(Equal("me@example.com"))
+
+			w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "renamed", Password: "testpass123"}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			w = performRequest(router, "PATCH", "/users/me", map[string]string{"email": ""}, testToken)
+			var cleared models.User
+			json.Unmarshal(w.Body.Bytes(), &cleared)
+			Expect(cleared.Email).To(BeNil())
+			Expect(cleared.DisplayName).To(Equal("Test User"))
+		})
+
+		It("should reject a username that is taken", func() {
+			w := performRequest(router, "PATCH", "/users/me", map[string]string{"username": "admin"}, testToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+		})
+
+		Describe("changing the password", func() {
+			It("should require the current password", func() {
+				w := performRequest(router, "POST", "/users/me/password", handlers.ChangePasswordRequest{CurrentPassword: "wrongpass", NewPassword: "brand-new-pass"}, testToken)
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should apply the password policy", func() {
+				w := performRequest(router, "POST", "/users/me/password", handlers.ChangePasswordRequest{CurrentPassword: "testpass123", NewPassword: "short"}, testToken)
+				Expect(w.Code).To(Equal(http.StatusBadRequest))
+			})
+
+			It("should keep the current session and revoke the others", func() {
+				otherSession := createUserAndLogin(router, "testuser", "testpass123")
+
+				w := performRequest(router, "POST", "/users/me/password", handlers.ChangePasswordRequest{CurrentPassword: "testpass123", NewPassword: "brand-new-pass"}, testToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(performRequest(router, "GET", "/users/me", nil, testToken).Code).To(Equal(http.StatusOK))
+				Expect(performRequest(router, "GET", "/users/me", nil, otherSession).Code).To(Equal(http.StatusUnauthorized))
+
+				w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "brand-new-pass"}, "")
+				Expect(w.Code).To(Equal(http.StatusOK))
+			})
+		})
+
+		Describe("deleting the account", func() {
+			var orderID uint
+
+			BeforeEach(func() {
+				w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+				var cart models.Cart
+				json.Unmarshal(w.Body.Bytes(), &cart)
+				w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+				var order models.Order
+				json.Unmarshal(w.Body.Bytes(), &order)
+				orderID = order.ID
+
+				performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, testToken)
+			})
+
+			It("should require the password", func() {
+				w := performRequest(router, "DELETE", "/users/me", handlers.DeleteAccountRequest{Password: "wrongpass"}, testToken)
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+			})
+
+			It("should delete the user and keep anonymized orders", func() {
+				w := performRequest(router, "DELETE", "/users/me", handlers.DeleteAccountRequest{Password: "testpass123"}, testToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+
+				Expect(performRequest(router, "GET", "/users/me", nil, testToken).Code).To(Equal(http.StatusUnauthorized))
+				w = performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: "testuser", Password: "testpass123"}, "")
+				Expect(w.Code).To(Equal(http.StatusUnauthorized))
+
+				var order models.Order
+				Expect(database.DB.Preload("Lines").Where("id = ?", orderID).First(&order).Error).ToNot(HaveOccurred())
+				Expect(order.UserID).To(Equal(uint(models.DeletedUserID)))
+				Expect(order.Lines).To(HaveLen(1))
+
+				var count int
+				database.DB.Model(&models.Cart{}).Where("status = ?", models.CartStatusActive).Count(&count)
+				Expect(count).To(Equal(0))
+			})
+
+			It("should free the username", func() {
+				performRequest(router, "DELETE", "/users/me", handlers.DeleteAccountRequest{Password: "testpass123"}, testToken)
+				Expect(createUserAndLogin(router, "testuser", "another-pass-1")).ToNot(BeEmpty())
+			})
+		})
+	})
+	Describe("Data Export", func() {
+		var testUserID uint
+
+		BeforeEach(func() {
+			var user models.User
+			database.DB.Where("username = ?", "testuser").First(&user)
+			testUserID = user.ID
+
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 2}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+		})
+
+		It("should export the user's data as JSON", func() {
+			w := performRequest(router, "GET", "/users/me/export", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Disposition")).To(MatchRegexp(`attachment; filename="user-\d+-export-.*\.json"`))
+
+			var export handlers.UserExport
+			Expect(json.Unmarshal(w.Body.Bytes(), &export)).To(Succeed())
+			Expect(export.Profile.Username).To(Equal("testuser"))
+			Expect(export.Sessions).To(HaveLen(1))
+			Expect(export.Carts).To(HaveLen(1))
+			Expect(export.Carts[0].CartItems).To(HaveLen(2))
+			Expect(export.Orders).To(HaveLen(1))
+			Expect(export.Orders[0].Lines).To(HaveLen(2))
+			Expect(w.Body.String()).ToNot(ContainSubstring(testToken))
+			Expect(w.Body.String()).ToNot(ContainSubstring(`"user":`))
+		})
+
+		It("should export a zip of JSON files", func() {
+			w := performRequest(router, "GET", "/users/me/export?format=zip", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Header().Get("Content-Type")).To(Equal("application/zip"))
+
+			archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+			Expect(err).ToNot(HaveOccurred())
+			var names []string
+			for _, file := range archive.File {
+				names = append(names, file.Name)
+			}
+			Expect(names).To(ConsistOf("profile.json", "sessions.json", "carts.json", "wishlists.json", "orders.json"))
+
+			file, _ := archive.Open("orders.json")
+			var orders []models.Order
+			Expect(json.NewDecoder(file).Decode(&orders)).To(Succeed())
+			Expect(orders).To(HaveLen(1))
+		})
+
+		It("should reject unknown formats", func() {
+			Expect(performRequest(router, "GET", "/users/me/export?format=xml", nil, testToken).Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should let only admins export other users", func() {
+			path := fmt.Sprintf("/users/%d/export", testUserID)
+			Expect(performRequest(router, "GET", path, nil, testToken).Code).To(Equal(http.StatusForbidden))
+
+			w := performRequest(router, "GET", path, nil, adminToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var export handlers.UserExport
+			json.Unmarshal(w.Body.Bytes(), &export)
+			Expect(export.Profile.ID).To(Equal(testUserID))
+
+			Expect(performRequest(router, "GET", "/users/9999/export", nil, adminToken).Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should record every export in the audit log", func() {
+			performRequest(router, "GET", "/users/me/export", nil, testToken)
+			performRequest(router, "GET", fmt.Sprintf("/users/%d/export?format=zip", testUserID), nil, adminToken)
+
+			var admin models.User
+			database.DB.Where("username = ?", "admin").First(&admin)
+
+			var entries []models.AuditLog
+			database.DB.Where("action = ?", models.AuditActionUserExport).Order("id").Find(&entries)
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].ActorID).To(Equal(testUserID))
+			Expect(entries[0].SubjectUserID).To(Equal(testUserID))
+			Expect(entries[1].ActorID).To(Equal(admin.ID))
+			Expect(entries[1].SubjectUserID).To(Equal(testUserID))
+			Expect(entries[1].Details).To(Equal("format=zip"))
+		})
+	})
+	Describe("API Keys", func() {
+		createKey := func(token string, req handlers.CreateAPIKeyRequest) (*httptest.ResponseRecorder, string) {
+			w := performRequest(router, "POST", "/users/me/api-keys", req, token)
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			key, _ := resp["key"].(string)
+			return w, key
+		}
+
+		withAPIKey := func(method, path string, payload interface{}, key string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(payload)
+			req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", key)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		It("should create a key that is only shown once", func() {
+			w, key := createKey(testToken, handlers.CreateAPIKeyRequest{Name: "warehouse", Scopes: []string{models.ScopeOrdersRead}})
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(key).To(HavePrefix(models.APIKeyPrefix))
+
+			w = performRequest(router, "GET", "/users/me/api-keys", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).ToNot(ContainSubstring(key))
+
+			var keys []models.APIKey
+			json.Unmarshal(w.Body.Bytes(), &keys)
+			Expect(keys).To(HaveLen(1))
+			Expect(keys[0].Name).To(Equal("warehouse"))
+			Expect(keys[0].ScopeList).To(Equal([]string{models.ScopeOrdersRead}))
+			Expect(key).To(HavePrefix(keys[0].Prefix))
+		})
+
+		It("should validate scopes against the owner's role", func() {
+			w, _ := createKey(testToken, handlers.CreateAPIKeyRequest{Name: "bad", Scopes: []string{"everything"}})
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+
+			w, _ = createKey(testToken, handlers.CreateAPIKeyRequest{Name: "items", Scopes: []string{models.ScopeItemsWrite}})
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+
+			w, _ = createKey(adminToken, handlers.CreateAPIKeyRequest{Name: "items", Scopes: []string{models.ScopeItemsWrite}})
+			Expect(w.Code).To(Equal(http.StatusCreated))
+		})
+
+		It("should authenticate as the owner within the key's scopes", func() {
+			_, key := createKey(adminToken, handlers.CreateAPIKeyRequest{Name: "warehouse", Scopes: []string{models.ScopeItemsWrite, models.ScopeOrdersRead}})
+
+			Expect(withAPIKey("POST", "/items", handlers.CreateItemRequest{Name: "Webcam", Price: 3999}, key).Code).To(Equal(http.StatusCreated))
+			Expect(withAPIKey("GET", "/orders", nil, key).Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", "/orders", nil, key).Code).To(Equal(http.StatusOK))
+
+			w := withAPIKey("POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, key)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			Expect(w.Body.String()).To(ContainSubstring("missing scope: carts:write"))
+		})
+
+		It("should not be usable on account routes", func() {
+			_, key := createKey(testToken, handlers.CreateAPIKeyRequest{Name: "all", Scopes: []string{models.ScopeCartsRead, models.ScopeCartsWrite, models.ScopeOrdersRead, models.ScopeOrdersWrite}})
+
+			Expect(withAPIKey("GET", "/users/me", nil, key).Code).To(Equal(http.StatusForbidden))
+			Expect(withAPIKey("POST", "/users/me/api-keys", handlers.CreateAPIKeyRequest{Name: "more", Scopes: []string{models.ScopeCartsRead}}, key).Code).To(Equal(http.StatusForbidden))
+			Expect(withAPIKey("DELETE", "/users/me", handlers.DeleteAccountRequest{Password: "testpass123"}, key).Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should record when a key was last used", func() {
+			_, key := createKey(testToken, handlers.CreateAPIKeyRequest{Name: "reader", Scopes: []string{models.ScopeOrdersRead}})
+			withAPIKey("GET", "/orders", nil, key)
+
+			var apiKey models.APIKey
+			database.DB.Where("key_hash = ?", models.HashSessionToken(key)).First(&apiKey)
+			Expect(apiKey.LastUsedAt).ToNot(BeNil())
+		})
+
+		It("should stop working once expired or revoked", func() {
+			expiresAt := time.Now().Add(time.Hour)
+			w, key := createKey(testToken, handlers.CreateAPIKeyRequest{Name: "temp", Scopes: []string{models.ScopeOrdersRead}, ExpiresAt: &expiresAt})
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(withAPIKey("GET", "/orders", nil, key).Code).To(Equal(http.StatusOK))
+
+			database.DB.Model(&models.APIKey{}).Update("expires_at", time.Now().Add(-time.Minute))
+			Expect(withAPIKey("GET", "/orders", nil, key).Code).To(Equal(http.StatusUnauthorized))
+
+			_, key = createKey(testToken, handlers.CreateAPIKeyRequest{Name: "revoked", Scopes: []string{models.ScopeOrdersRead}})
+			var apiKey models.APIKey
+			database.DB.Where("key_hash = ?", models.HashSessionToken(key)).First(&apiKey)
+
+			otherToken := createUserAndLogin(router, "otheruser", "otherpass123")
+			Expect(performRequest(router, "DELETE", fmt.Sprintf("/users/me/api-keys/%d", apiKey.ID), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+			Expect(performRequest(router, "DELETE", fmt.Sprintf("/users/me/api-keys/%d", apiKey.ID), nil, testToken).Code).To(Equal(http.StatusOK))
+			Expect(withAPIKey("GET", "/orders", nil, key).Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+	Describe("Guest Carts", func() {
+		withCartToken := func(method, path string, payload interface{}, cartToken string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(payload)
+			req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			if cartToken != "" {
+				req.Header.Set(handlers.CartTokenHeader, cartToken)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		addItems := func(cartToken string, itemIDs ...uint) string {
+			w := withCartToken("POST", "/carts/guest", handlers.CreateCartRequest{ItemIDs: itemIDs}, cartToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var resp struct {
+				CartToken string `json:"cart_token"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.CartToken).ToNot(BeEmpty())
+			return resp.CartToken
+		}
+
+		getUserCart := func(token string) models.Cart {
+			w := performRequest(router, "GET", "/carts/me", nil, token)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return cart
+		}
+
+		It("should keep a cart for a visitor without an account", func() {
+			cartToken := addItems("", 1, 2)
+			cartToken = addItems(cartToken, 2)
+
+			w := withCartToken("GET", "/carts/guest", nil, cartToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Guest).To(BeTrue())
+			Expect(cart.TotalQuantity).To(Equal(3))
+
+			w = withCartToken("PATCH", "/carts/guest/items/2", gin.H{"quantity": 5}, cartToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			w = withCartToken("DELETE", "/carts/guest/items/1", nil, cartToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.CartItems[0].Quantity).To(Equal(5))
+		})
+
+		It("should reject tampered and expired tokens", func() {
+			cartToken := addItems("", 1)
+			otherCart := strings.Replace(cartToken, strings.SplitN(cartToken, ".", 2)[0], "999", 1)
+			Expect(withCartToken("GET", "/carts/guest", nil, otherCart).Code).To(Equal(http.StatusUnauthorized))
+
+			expired := auth.SignCartToken(1, time.Now().Add(-time.Minute), config.Current.CartTokenSecret)
+			Expect(withCartToken("GET", "/carts/guest", nil, expired).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should not let a guest cart token reach a user's cart", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			var user models.User
+			database.DB.Where("username = ?", "testuser").First(&user)
+
+			cartToken := auth.SignCartToken(*user.CartID, time.Now().Add(time.Hour), config.Current.CartTokenSecret)
+			Expect(withCartToken("GET", "/carts/guest", nil, cartToken).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should delete guest carts once their token expires", func() {
+			addItems("", 1)
+			cartToken := addItems("", 2)
+
+			var expired models.Cart
+			database.DB.Where("guest = ?", true).Order("id").First(&expired)
+			database.DB.Model(&expired).Update("expires_at", time.Now().Add(-time.Minute))
+			database.DeleteExpiredGuestCarts()
+
+			var carts []models.Cart
+			database.DB.Where("guest = ?", true).Find(&carts)
+			Expect(carts).To(HaveLen(1))
+			var lines int
+			database.DB.Model(&models.CartItem{}).Where("cart_id = ?", expired.ID).Count(&lines)
+			Expect(lines).To(BeZero())
+
+			Expect(withCartToken("GET", "/carts/guest", nil, cartToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should not hold stock for guest carts", func() {
+			config.Current.StockHoldsEnabled = true
+
+			addItems("", 1)
+
+			var holds int
+			database.DB.Model(&models.StockHold{}).Count(&holds)
+			Expect(holds).To(BeZero())
+		})
+
+		It("should keep guest carts apart from carts of deleted users", func() {
+			addItems("", 1)
+
+			w := performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+			performRequest(router, "DELETE", "/users/me", handlers.DeleteAccountRequest{Password: "testpass123"}, testToken)
+
+			w = performRequest(router, "GET", fmt.Sprintf("/carts?user_id=%d", models.DeletedUserID), nil, adminToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var carts []models.Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			Expect(carts).To(HaveLen(1))
+			Expect(carts[0].ID).To(Equal(cart.ID))
+			Expect(carts[0].Guest).To(BeFalse())
+
+			Expect(performRequest(router, "GET", fmt.Sprintf("/carts/%d", cart.ID), nil, adminToken).Code).To(Equal(http.StatusOK))
+		})
+
+		It("should merge the guest cart on login and report each line", func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			cartToken := addItems("", 1, 1, 2, 3)
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Update("status", "inactive")
+
+			body, _ := json.Marshal(handlers.LoginRequest{Username: "testuser", Password: "testpass123"})
+			req := httptest.NewRequest("POST", "/users/login", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(handlers.CartTokenHeader, cartToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var resp struct {
+				Token     string                   `json:"token"`
+				CartMerge handlers.CartMergeReport `json:"cart_merge"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.CartMerge.Lines).To(ConsistOf(
+				handlers.CartMergeLine{ItemID: 1, Quantity: 2, Outcome: handlers.CartMergeMerged, CartQuantity: 3},
+				handlers.CartMergeLine{ItemID: 2, Quantity: 1, Outcome: handlers.CartMergeAdded, CartQuantity: 1},
+				handlers.CartMergeLine{ItemID: 3, Quantity: 1, Outcome: handlers.CartMergeSkipped, Reason: "inactive"},
+			))
+
+			cart := getUserCart(resp.Token)
+			Expect(cart.ID).To(Equal(resp.CartMerge.CartID))
+			Expect(cart.TotalQuantity).To(Equal(4))
+
+			// The guest cart is gone, so its token no longer works
+			Expect(withCartToken("GET", "/carts/guest", nil, cartToken).Code).To(Equal(http.StatusUnauthorized))
+		})
+
+		It("should give a new account the guest cart on sign-up", func() {
+			cartToken := addItems("", 4, 4)
+
+			body, _ := json.Marshal(handlers.CreateUserRequest{Username: "shopper", Password: "newuserpass42"})
+			req := httptest.NewRequest("POST", "/users", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(handlers.CartTokenHeader, cartToken)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			var resp struct {
+				Username  string                   `json:"username"`
+				CartMerge handlers.CartMergeReport `json:"cart_merge"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Username).To(Equal("shopper"))
+			Expect(resp.CartMerge.Lines).To(Equal([]handlers.CartMergeLine{
+				{ItemID: 4, Quantity: 2, Outcome: handlers.CartMergeAdded, CartQuantity: 2},
+			}))
+
+			token := createUserAndLogin(router, "shopper", "newuserpass42")
+			cart := getUserCart(token)
+			Expect(cart.TotalQuantity).To(Equal(2))
+		})
+
+		It("should log in normally with a stale cart token", func() {
+			expired := auth.SignCartToken(1, time.Now().Add(-time.Minute), config.Current.CartTokenSecret)
+
+			body, _ := json.Marshal(handlers.LoginRequest{Username: "testuser", Password: "testpass123"})
+			req := httptest.NewRequest("POST", "/users/login", bytes.NewBuffer(body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(handlers.CartTokenHeader, expired)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).ToNot(ContainSubstring("cart_merge"))
+		})
+	})
+	Describe("Named Carts", func() {
+		createNamedCart := func(req handlers.CreateNamedCartRequest) models.Cart {
+			w := performRequest(router, "POST", "/carts/new", req, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			return cart
+		}
+
+		listCarts := func() []models.Cart {
+			w := performRequest(router, "GET", "/carts", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var carts []models.Cart
+			json.Unmarshal(w.Body.Bytes(), &carts)
+			return carts
+		}
+
+		It("should create named carts and activate the first one", func() {
+			office := createNamedCart(handlers.CreateNamedCartRequest{Name: " Office refresh "})
+			Expect(office.Name).To(Equal("Office refresh"))
+			Expect(office.Active).To(BeTrue())
+
+			spares := createNamedCart(handlers.CreateNamedCartRequest{Name: "Q3 spares"})
+			Expect(spares.Active).To(BeFalse())
+
+			carts := listCarts()
+			Expect(carts).To(HaveLen(2))
+			for _, cart := range carts {
+				Expect(cart.Active).To(Equal(cart.ID == office.ID))
+			}
+
+			w := performRequest(router, "POST", "/carts/new", handlers.CreateNamedCartRequest{Name: "   "}, testToken)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should switch the cart that /carts/me works on", func() {
+			office := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh"})
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			spares := createNamedCart(handlers.CreateNamedCartRequest{Name: "Q3 spares", Activate: true})
+			Expect(spares.Active).To(BeTrue())
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2, 3}}, testToken)
+
+			w := performRequest(router, "POST", fmt.Sprintf("/carts/%d/activate", office.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			var cart models.Cart
+			w = performRequest(router, "GET", "/carts/me", nil, testToken)
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.ID).To(Equal(office.ID))
+			Expect(cart.TotalQuantity).To(Equal(1))
+
+			w = performRequest(router, "GET", fmt.Sprintf("/carts/%d", spares.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.TotalQuantity).To(Equal(2))
+			Expect(cart.Active).To(BeFalse())
+		})
+
+		It("should rename a cart", func() {
+			cart := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh"})
+
+			w := performRequest(router, "PATCH", fmt.Sprintf("/carts/%d", cart.ID), handlers.RenameCartRequest{Name: "Office refresh 2"}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.Name).To(Equal("Office refresh 2"))
+		})
+
+		It("should delete an open cart with its lines", func() {
+			cart := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh"})
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+
+			w := performRequest(router, "DELETE", fmt.Sprintf("/carts/%d", cart.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(listCarts()).To(BeEmpty())
+
+			var lines int
+			database.DB.Model(&models.CartItem{}).Where("cart_id = ?", cart.ID).Count(&lines)
+			Expect(lines).To(Equal(0))
+
+			w = performRequest(router, "GET", "/carts/me", nil, testToken)
+			Expect(w.Body.String()).To(ContainSubstring("No active cart"))
+		})
+
+		It("should keep checked out carts", func() {
+			cart := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh"})
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cart.ID}, testToken)
+
+			Expect(performRequest(router, "DELETE", fmt.Sprintf("/carts/%d", cart.ID), nil, testToken).Code).To(Equal(http.StatusConflict))
+			Expect(performRequest(router, "POST", fmt.Sprintf("/carts/%d/activate", cart.ID), nil, testToken).Code).To(Equal(http.StatusConflict))
+		})
+
+		It("should place an order from a cart that is not active", func() {
+			spares := createNamedCart(handlers.CreateNamedCartRequest{Name: "Q3 spares"})
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{2}}, testToken)
+			office := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh", Activate: true})
+
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: spares.ID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			w = performRequest(router, "GET", "/carts/me", nil, testToken)
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.ID).To(Equal(office.ID))
+		})
+
+		It("should not expose other users' carts", func() {
+			cart := createNamedCart(handlers.CreateNamedCartRequest{Name: "Office refresh"})
+			otherToken := createUserAndLogin(router, "otheruser", "otherpass123")
+
+			Expect(performRequest(router, "GET", fmt.Sprintf("/carts/%d", cart.ID), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+			Expect(performRequest(router, "PATCH", fmt.Sprintf("/carts/%d", cart.ID), handlers.RenameCartRequest{Name: "Mine"}, otherToken).Code).To(Equal(http.StatusNotFound))
+			Expect(performRequest(router, "DELETE", fmt.Sprintf("/carts/%d", cart.ID), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+			Expect(performRequest(router, "POST", fmt.Sprintf("/carts/%d/activate", cart.ID), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+
+			Expect(performRequest(router, "GET", fmt.Sprintf("/carts/%d", cart.ID), nil, adminToken).Code).To(Equal(http.StatusOK))
+		})
+	})
+	Describe("Wishlists", func() {
+		createWishlist := func(req handlers.CreateWishlistRequest, token string) models.Wishlist {
+			w := performRequest(router, "POST", "/wishlists", req, token)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var wishlist models.Wishlist
+			json.Unmarshal(w.Body.Bytes(), &wishlist)
+			return wishlist
+		}
+
+		quantity := func(n int) *int { return &n }
+
+		type moveResponse struct {
+			Wishlist models.Wishlist `json:"wishlist"`
+			Cart     models.Cart     `json:"cart"`
+		}
+
+		move := func(wishlistID uint, direction string, req handlers.WishlistItemRequest) (int, moveResponse) {
+			w := performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/%s", wishlistID, direction), req, testToken)
+			var resp moveResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return w.Code, resp
+		}
+
+		It("should create, rename and delete wishlists", func() {
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Birthday"}, testToken)
+			Expect(wishlist.Notify).To(BeFalse())
+
+			w := performRequest(router, "PATCH", fmt.Sprintf("/wishlists/%d", wishlist.ID), gin.H{"name": "Christmas", "notify": true}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &wishlist)
+			Expect(wishlist.Name).To(Equal("Christmas"))
+			Expect(wishlist.Notify).To(BeTrue())
+
+			w = performRequest(router, "GET", "/wishlists", nil, testToken)
+			var wishlists []models.Wishlist
+			json.Unmarshal(w.Body.Bytes(), &wishlists)
+			Expect(wishlists).To(HaveLen(1))
+
+			otherToken := createUserAndLogin(router, "otheruser", "otherpass123")
+			Expect(performRequest(router, "GET", fmt.Sprintf("/wishlists/%d", wishlist.ID), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+
+			w = performRequest(router, "DELETE", fmt.Sprintf("/wishlists/%d", wishlist.ID), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", fmt.Sprintf("/wishlists/%d", wishlist.ID), nil, testToken).Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("should add and remove items", func() {
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Later"}, testToken)
+			path := fmt.Sprintf("/wishlists/%d/items", wishlist.ID)
+
+			performRequest(router, "POST", path, handlers.WishlistItemRequest{ItemID: 1}, testToken)
+			w := performRequest(router, "POST", path, handlers.WishlistItemRequest{ItemID: 1, Quantity: quantity(2)}, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &wishlist)
+			Expect(wishlist.Items).To(HaveLen(1))
+			Expect(wishlist.Items[0].Quantity).To(Equal(3))
+
+			Expect(performRequest(router, "POST", path, handlers.WishlistItemRequest{ItemID: 999}, testToken).Code).To(Equal(http.StatusNotFound))
+
+			w = performRequest(router, "DELETE", path+"/1", nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			json.Unmarshal(w.Body.Bytes(), &wishlist)
+			Expect(wishlist.Items).To(BeEmpty())
+		})
+
+		It("should move cart lines to the wishlist and back with their quantity", func() {
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Later"}, testToken)
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 1, 1, 2}}, testToken)
+
+			code, resp := move(wishlist.ID, "move-from-cart", handlers.WishlistItemRequest{ItemID: 1, Quantity: quantity(2)})
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.Cart.TotalQuantity).To(Equal(2))
+			Expect(resp.Wishlist.Items).To(HaveLen(1))
+			Expect(resp.Wishlist.Items[0].Quantity).To(Equal(2))
+
+			code, resp = move(wishlist.ID, "move-from-cart", handlers.WishlistItemRequest{ItemID: 2})
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.Cart.CartItems).To(HaveLen(1))
+			Expect(resp.Wishlist.Items).To(HaveLen(2))
+
+			code, _ = move(wishlist.ID, "move-from-cart", handlers.WishlistItemRequest{ItemID: 1, Quantity: quantity(5)})
+			Expect(code).To(Equal(http.StatusBadRequest))
+
+			code, resp = move(wishlist.ID, "move-to-cart", handlers.WishlistItemRequest{ItemID: 1})
+			Expect(code).To(Equal(http.StatusOK))
+			Expect(resp.Cart.CartItems).To(HaveLen(1))
+			Expect(resp.Cart.CartItems[0].Quantity).To(Equal(3))
+			Expect(resp.Wishlist.Items).To(HaveLen(1))
+			Expect(resp.Wishlist.Items[0].ItemID).To(Equal(uint(2)))
+		})
+
+		It("should keep stock holds in step with moved lines", func() {
+			config.Current.StockHoldsEnabled = true
+			defer func() { config.Current = config.Defaults() }()
+
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Later"}, testToken)
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1, 1}}, testToken)
+
+			held := func() int {
+				var hold models.StockHold
+				if database.DB.Where("item_id = ?", 1).First(&hold).Error != nil {
+					return 0
+				}
+				return hold.Quantity
+			}
+			Expect(held()).To(Equal(2))
+
+			move(wishlist.ID, "move-from-cart", handlers.WishlistItemRequest{ItemID: 1})
+			Expect(held()).To(Equal(0))
+
+			move(wishlist.ID, "move-to-cart", handlers.WishlistItemRequest{ItemID: 1, Quantity: quantity(1)})
+			Expect(held()).To(Equal(1))
+		})
+
+		It("should not move an inactive item into the cart", func() {
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Later"}, testToken)
+			performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: 3}, testToken)
+			database.DB.Model(&models.Item{}).Where("id = ?", 3).Update("status", "inactive")
+
+			code, _ := move(wishlist.ID, "move-to-cart", handlers.WishlistItemRequest{ItemID: 3})
+			Expect(code).To(Equal(http.StatusConflict))
+		})
+
+		It("should not move an item priced in another currency into the cart", func() {
+			w := performRequest(router, "POST", "/items", handlers.CreateItemRequest{Name: "Webcam", Price: 3999, Currency: "EUR"}, adminToken)
+			var webcam models.Item
+			json.Unmarshal(w.Body.Bytes(), &webcam)
+
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Later"}, testToken)
+			performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: webcam.ID}, testToken)
+
+			code, _ := move(wishlist.ID, "move-to-cart", handlers.WishlistItemRequest{ItemID: webcam.ID})
+			Expect(code).To(Equal(http.StatusBadRequest))
+		})
+
+		Describe("notifications", func() {
+			var outbox *mail.OutboxMailer
+
+			BeforeEach(func() {
+				dir, err := os.MkdirTemp("", "outbox")
+				Expect(err).ToNot(HaveOccurred())
+				outbox = &mail.OutboxMailer{Dir: dir}
+				handlers.Mailer = outbox
+
+				performRequest(router, "PATCH", "/users/me", gin.H{"email": "test@example.com"}, testToken)
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(outbox.Dir)
+			})
+
+			messages := func() []string {
+				handlers.SendQueuedEmails()
+				paths, err := outbox.Messages()
+				Expect(err).ToNot(HaveOccurred())
+				bodies := make([]string, len(paths))
+				for i, path := range paths {
+					body, _ := os.ReadFile(path)
+					bodies[i] = string(body)
+				}
+				return bodies
+			}
+
+			updateItem := func(id uint, req handlers.UpdateItemRequest) {
+				w := performRequest(router, "PATCH", fmt.Sprintf("/items/%d", id), req, adminToken)
+				Expect(w.Code).To(Equal(http.StatusOK))
+			}
+
+			It("should email watchers when an item returns or gets cheaper", func() {
+				wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Watching", Notify: true}, testToken)
+				performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: 2}, testToken)
+
+				inactive, active := "inactive", models.ItemStatusActive
+				updateItem(2, handlers.UpdateItemRequest{Status: &inactive})
+				Expect(messages()).To(BeEmpty())
+
+				updateItem(2, handlers.UpdateItemRequest{Status: &active})
+				Expect(messages()).To(HaveLen(1))
+				Expect(messages()[0]).To(ContainSubstring("Mouse is available again"))
+
+				higher, lower := int64(3000), int64(1999)
+				updateItem(2, handlers.UpdateItemRequest{Price: &higher})
+				Expect(messages()).To(HaveLen(1))
+
+				updateItem(2, handlers.UpdateItemRequest{Price: &lower})
+				Expect(messages()).To(HaveLen(2))
+				Expect(strings.Join(messages(), "\n")).To(ContainSubstring("Mouse dropped in price"))
+			})
+
+			It("should keep item names from adding mail headers", func() {
+				wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Watching", Notify: true}, testToken)
+				performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: 2}, testToken)
+				database.DB.Model(&models.Item{}).Where("id = ?", 2).Update("name", "Mouse\r\nBcc: someone@example.com")
+
+				lower := int64(1999)
+				updateItem(2, handlers.UpdateItemRequest{Price: &lower})
+				Expect(messages()).To(HaveLen(1))
+				headers := strings.SplitN(messages()[0], "\r\n\r\n", 2)[0]
+				Expect(headers).ToNot(ContainSubstring("\r\nBcc:"))
+				Expect(headers).To(ContainSubstring("Subject: =?utf-8?q?"))
+			})
+
+			It("should queue notifications instead of waiting on the mail server", func() {
+				wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Watching", Notify: true}, testToken)
+				performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: 2}, testToken)
+
+				handlers.Mailer = &mail.SMTPMailer{Addr: "127.0.0.1:1", From: "shop@example.com"}
+				lower := int64(1999)
+				updateItem(2, handlers.UpdateItemRequest{Price: &lower})
+
+				handlers.SendQueuedEmails()
+				var queued models.QueuedEmail
+				Expect(database.DB.First(&queued).Error).ToNot(HaveOccurred())
+				Expect(queued.Attempts).To(Equal(1))
+				Expect(queued.LastError).ToNot(BeEmpty())
+
+				handlers.Mailer = outbox
+				Expect(messages()).To(HaveLen(1))
+				var count int
+				database.DB.Model(&models.QueuedEmail{}).Count(&count)
+				Expect(count).To(BeZero())
+			})
+
+			It("should not email users who did not ask for it", func() {
+				wishlist := createWishlist(handlers.CreateWishlistRequest{Name: "Quiet"}, testToken)
+				performRequest(router, "POST", fmt.Sprintf("/wishlists/%d/items", wishlist.ID), handlers.WishlistItemRequest{ItemID: 2}, testToken)
+
+				lower := int64(1999)
+				updateItem(2, handlers.UpdateItemRequest{Price: &lower})
+				Expect(messages()).To(BeEmpty())
+			})
+		})
+	})
+	Describe("Shared Carts", func() {
+		var cartID uint
+		var otherToken string
+
+		BeforeEach(func() {
+			performRequest(router, "POST", "/carts", handlers.CreateCartRequest{ItemIDs: []uint{1}}, testToken)
+			var user models.User
+			database.DB.Where("username = ?", "testuser").First(&user)
+			cartID = *user.CartID
+
+			otherToken = createUserAndLogin(router, "otheruser", "otherpass123")
+		})
+
+		cartPath := func(suffix string) string {
+			return fmt.Sprintf("/carts/%d%s", cartID, suffix)
+		}
+
+		createShare := func(req handlers.CreateCartShareRequest) string {
+			w := performRequest(router, "POST", cartPath("/shares"), req, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			var resp struct {
+				Path string `json:"path"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			return resp.Path
+		}
+
+		invite := func(access string) {
+			w := performRequest(router, "POST", cartPath("/collaborators"), handlers.AddCartCollaboratorRequest{Username: "otheruser", Access: access}, testToken)
+			Expect(w.Code).To(BeElementOf(http.StatusCreated, http.StatusOK))
+		}
+
+		changes := func() []models.CartChange {
+			w := performRequest(router, "GET", cartPath("/changes"), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var list []models.CartChange
+			json.Unmarshal(w.Body.Bytes(), &list)
+			return list
+		}
+
+		It("should leave the cart and its change log alone when an update fails", func() {
+			database.DB.Exec("DELETE FROM items WHERE id = ?", 1)
+
+			w := performRequest(router, "PATCH", cartPath("/items/1"), gin.H{"quantity": 3}, testToken)
+			Expect(w.Code).To(Equal(http.StatusInternalServerError))
+
+			var line models.CartItem
+			database.DB.Where("cart_id = ? AND item_id = ?", cartID, 1).First(&line)
+			Expect(line.Quantity).To(Equal(1))
+			Expect(changes()).To(HaveLen(1))
+		})
+
+		It("should not reveal private user details to collaborators", func() {
+			performRequest(router, "PATCH", "/users/me", gin.H{"email": "test@example.com"}, testToken)
+			performRequest(router, "PATCH", "/users/me", gin.H{"email": "other@example.com"}, otherToken)
+
+			w := performRequest(router, "POST", cartPath("/collaborators"), handlers.AddCartCollaboratorRequest{Username: "otheruser", Access: models.CartAccessView}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+			Expect(w.Body.String()).To(ContainSubstring(`"username":"otheruser"`))
+			Expect(w.Body.String()).ToNot(ContainSubstring("other@example.com"))
+
+			w = performRequest(router, "GET", cartPath("/collaborators"), nil, otherToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).ToNot(ContainSubstring("other@example.com"))
+
+			w = performRequest(router, "GET", "/carts/shared", nil, otherToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(w.Body.String()).To(ContainSubstring(`"owner":{"id"`))
+			Expect(w.Body.String()).ToNot(ContainSubstring("test@example.com"))
+		})
+
+		It("should show the cart through a read-only link", func() {
+			path := createShare(handlers.CreateCartShareRequest{Access: models.CartAccessView})
+
+			w := performRequest(router, "GET", path, nil, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var resp struct {
+				Access string      `json:"access"`
+				Cart   models.Cart `json:"cart"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			Expect(resp.Access).To(Equal(models.CartAccessView))
+			Expect(resp.Cart.ID).To(Equal(cartID))
+
+			w = performRequest(router, "POST", path+"/items", handlers.CreateCartRequest{ItemIDs: []uint{2}}, "")
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should let an editable link change lines and record the link", func() {
+			path := createShare(handlers.CreateCartShareRequest{Access: models.CartAccessEdit})
+
+			w := performRequest(router, "POST", path+"/items", handlers.CreateCartRequest{ItemIDs: []uint{2}}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+			w = performRequest(router, "PATCH", path+"/items/2", gin.H{"quantity": 3}, "")
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			list := changes()
+			Expect(list[0].ItemID).To(Equal(uint(2)))
+			Expect(list[0].Action).To(Equal(models.CartChangeUpdated))
+			Expect(list[0].Quantity).To(Equal(3))
+			Expect(list[0].ShareID).ToNot(BeNil())
+		})
+
+		It("should reject expired and revoked links", func() {
+			path := createShare(handlers.CreateCartShareRequest{Access: models.CartAccessView})
+			database.DB.Model(&models.CartShare{}).Update("expires_at", time.Now().Add(-time.Minute))
+			Expect(performRequest(router, "GET", path, nil, "").Code).To(Equal(http.StatusNotFound))
+
+			path = createShare(handlers.CreateCartShareRequest{Access: models.CartAccessView})
+			var share models.CartShare
+			database.DB.Where("expires_at > ?", time.Now()).First(&share)
+			w := performRequest(router, "DELETE", cartPath(fmt.Sprintf("/shares/%d", share.ID)), nil, testToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", path, nil, "").Code).To(Equal(http.StatusNotFound))
+
+			past := time.Now().Add(-time.Hour)
+			w = performRequest(router, "POST", cartPath("/shares"), handlers.CreateCartShareRequest{Access: models.CartAccessView, ExpiresAt: &past}, testToken)
+			Expect(w.Code).To(Equal(http.StatusBadRequest))
+		})
+
+		It("should let only the owner manage sharing", func() {
+			invite(models.CartAccessEdit)
+
+			w := performRequest(router, "POST", cartPath("/shares"), handlers.CreateCartShareRequest{Access: models.CartAccessView}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+			w = performRequest(router, "PATCH", cartPath(""), handlers.RenameCartRequest{Name: "Mine"}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+		})
+
+		It("should let collaborators with edit access change lines", func() {
+			Expect(performRequest(router, "GET", cartPath(""), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+
+			invite(models.CartAccessView)
+			Expect(performRequest(router, "GET", cartPath(""), nil, otherToken).Code).To(Equal(http.StatusOK))
+			w := performRequest(router, "POST", cartPath("/items"), handlers.CreateCartRequest{ItemIDs: []uint{2}}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+
+			invite(models.CartAccessEdit)
+			w = performRequest(router, "POST", cartPath("/items"), handlers.CreateCartRequest{ItemIDs: []uint{2}}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			w = performRequest(router, "DELETE", cartPath("/items/1"), nil, otherToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			var cart models.Cart
+			json.Unmarshal(w.Body.Bytes(), &cart)
+			Expect(cart.CartItems).To(HaveLen(1))
+			Expect(cart.CartItems[0].ItemID).To(Equal(uint(2)))
+
+			var other models.User
+			database.DB.Where("username = ?", "otheruser").First(&other)
+			list := changes()
+			Expect(list).To(HaveLen(3))
+			Expect(list[0].Action).To(Equal(models.CartChangeRemoved))
+			Expect(list[0].ActorID).To(Equal(other.ID))
+			Expect(list[2].ActorID).ToNot(Equal(other.ID))
+
+			w = performRequest(router, "GET", "/carts/shared", nil, otherToken)
+			var shared []models.Cart
+			json.Unmarshal(w.Body.Bytes(), &shared)
+			Expect(shared).To(HaveLen(1))
+			Expect(shared[0].ID).To(Equal(cartID))
+		})
+
+		It("should let only the owner check out", func() {
+			invite(models.CartAccessEdit)
+
+			w := performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cartID}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusForbidden))
+
+			w = performRequest(router, "POST", "/orders", handlers.CreateOrderRequest{CartID: cartID}, testToken)
+			Expect(w.Code).To(Equal(http.StatusCreated))
+
+			w = performRequest(router, "POST", cartPath("/items"), handlers.CreateCartRequest{ItemIDs: []uint{2}}, otherToken)
+			Expect(w.Code).To(Equal(http.StatusConflict))
+		})
+
+		It("should let collaborators leave a cart", func() {
+			invite(models.CartAccessView)
+			var other models.User
+			database.DB.Where("username = ?", "otheruser").First(&other)
+
+			w := performRequest(router, "DELETE", cartPath(fmt.Sprintf("/collaborators/%d", other.ID)), nil, otherToken)
+			Expect(w.Code).To(Equal(http.StatusOK))
+			Expect(performRequest(router, "GET", cartPath(""), nil, otherToken).Code).To(Equal(http.StatusNotFound))
+		})
+	})
+})
+
+func performRequest(router *gin.Engine, method, path string, payload interface{}, token string) *httptest.ResponseRecorder {
+	var body []byte
+	if payload != nil {
+		body, _ = json.Marshal(payload)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func createUserAndLogin(router *gin.Engine, username, password string) string {
+	performRequest(router, "POST", "/users", handlers.CreateUserRequest{Username: username, Password: password}, "")
+	w := performRequest(router, "POST", "/users/login", handlers.LoginRequest{Username: username, Password: password}, "")
+
+	var loginResp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &loginResp)
+	token, _ := loginResp["token"].(string)
+	return token
+}
+
+// startFakeSMTPServer accepts a single SMTP session and sends the DATA it
+// received on the returned channel.
+func startFakeSMTPServer() (string, chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+
+	received := make(chan string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+		reply("220 localhost fake SMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.TrimSpace(line))
+			switch {
+			case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+				reply("250 localhost")
+			case strings.HasPrefix(command, "DATA"):
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					data.WriteString(dataLine)
+				}
+				received <- data.String()
+				reply("250 OK")
+			case strings.HasPrefix(command, "QUIT"):
+				reply("221 Bye")
+				return
+			default:
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
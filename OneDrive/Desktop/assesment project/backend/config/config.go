@@ -0,0 +1,268 @@
+package config
+
+import (
+	"crypto/rand"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+// Authentication modes
+const (
+	// Bearer tokens are opaque session tokens looked up in the database
+	AuthModeOpaque = "opaque"
+	// Bearer tokens are signed JWT access tokens renewed with refresh tokens
+	AuthModeJWT = "jwt"
+)
+
+// Config holds settings read from the environment. Current starts out with
+// the defaults so tests can use it without calling Load.
+type Config struct {
+	// Admin account created at startup when both are set
+	AdminUsername string
+	AdminPassword string
+
+	// How long a login session (and in JWT mode its refresh token) stays valid
+	SessionTTL time.Duration
+
+	// Opaque session tokens or JWT access tokens, and the JWT settings
+	AuthMode       string
+	JWTSecret      []byte
+	JWTIssuer      string
+	AccessTokenTTL time.Duration
+
+	// Issuer shown in authenticator apps, and how long the challenge token
+	// from the password step of a two-factor login stays valid
+	TwoFactorIssuer       string
+	TwoFactorChallengeTTL time.Duration
+
+	// Password rules for new passwords, and how they are hashed: "bcrypt"
+	// with BcryptCost or "argon2id". Stored hashes made differently are
+	// upgraded at the next successful login.
+	PasswordMinLength int
+	PasswordHasher    string
+	BcryptCost        int
+
+	// Login throttling: failures allowed before exponential backoff starts
+	// (per account and per client IP), the backoff delays, and the account
+	// lockout threshold and duration
+	LoginFreeAttempts     int
+	LoginIPFreeAttempts   int
+	LoginBackoffBase      time.Duration
+	LoginBackoffMax       time.Duration
+	LoginLockoutThreshold int
+	LoginLockoutDuration  time.Duration
+
+	// Key signing guest cart tokens, how long a guest cart stays reachable
+	// after items were last added, and how often expired ones are deleted
+	CartTokenSecret        []byte
+	GuestCartTTL           time.Duration
+	GuestCartSweepInterval time.Duration
+
+	// Default lifetime of a cart share link
+	CartShareTTL time.Duration
+
+	// How long a password reset token is valid, and the page the emailed
+	// link points at (the token is appended as ?token=). A new token for the
+	// same account is only issued once PasswordResetCooldown has passed.
+	PasswordResetTTL      time.Duration
+	PasswordResetURL      string
+	PasswordResetCooldown time.Duration
+
+	// Mail delivery: "outbox" writes .eml files to MailOutboxDir, "smtp"
+	// sends through SMTPAddr
+	MailDriver    string
+	MailFrom      string
+	MailOutboxDir string
+	SMTPAddr      string
+	SMTPUsername  string
+	SMTPPassword  string
+
+	// How often queued emails are sent
+	MailQueueInterval time.Duration
+
+	// How long a stored Idempotency-Key response can be replayed
+	IdempotencyKeyTTL time.Duration
+
+	// Whether adding to a cart holds stock for that cart, for how long, and
+	// how often expired holds are released
+	StockHoldsEnabled      bool
+	StockHoldTTL           time.Duration
+	StockHoldSweepInterval time.Duration
+}
+
+var Current = Defaults()
+
+func Defaults() Config {
+	return Config{
+		SessionTTL:             7 * 24 * time.Hour,
+		AuthMode:               AuthModeOpaque,
+		JWTIssuer:              "shopping-cart",
+		AccessTokenTTL:         15 * time.Minute,
+		TwoFactorIssuer:        "Shopping Cart",
+		TwoFactorChallengeTTL:  5 * time.Minute,
+		PasswordMinLength:      8,
+		PasswordHasher:         "bcrypt",
+		BcryptCost:             10,
+		LoginFreeAttempts:      3,
+		LoginIPFreeAttempts:    20,
+		LoginBackoffBase:       time.Second,
+		LoginBackoffMax:        time.Minute,
+		LoginLockoutThreshold:  10,
+		LoginLockoutDuration:   15 * time.Minute,
+		CartTokenSecret:        randomSecret(),
+		GuestCartTTL:           30 * 24 * time.Hour,
+		GuestCartSweepInterval: time.Hour,
+		CartShareTTL:           7 * 24 * time.Hour,
+		PasswordResetTTL:       time.Hour,
+		PasswordResetURL:       "http://localhost:3000/reset-password",
+		PasswordResetCooldown:  15 * time.Minute,
+		MailDriver:             "outbox",
+		MailFrom:               "no-reply@shopping-cart.local",
+		MailOutboxDir:          "outbox",
+		MailQueueInterval:      10 * time.Second,
+		IdempotencyKeyTTL:      24 * time.Hour,
+		StockHoldsEnabled:      false,
+		StockHoldTTL:           15 * time.Minute,
+		StockHoldSweepInterval: time.Minute,
+	}
+}
+
+// Load reads the environment (and a .env file if present) into Current.
+func Load() {
+	// Load .env file if it exists (ignore error if file doesn't exist)
+	_ = godotenv.Load()
+
+	cfg := Defaults()
+	cfg.AdminUsername = os.Getenv("ADMIN_USERNAME")
+	cfg.AdminPassword = os.Getenv("ADMIN_PASSWORD")
+	cfg.SessionTTL = getDuration("SESSION_TTL", cfg.SessionTTL)
+	cfg.AuthMode = getEnv("AUTH_MODE", cfg.AuthMode)
+	cfg.JWTSecret = []byte(os.Getenv("JWT_SECRET"))
+	cfg.JWTIssuer = getEnv("JWT_ISSUER", cfg.JWTIssuer)
+	cfg.AccessTokenTTL = getDuration("ACCESS_TOKEN_TTL", cfg.AccessTokenTTL)
+	cfg.TwoFactorIssuer = getEnv("TWO_FACTOR_ISSUER", cfg.TwoFactorIssuer)
+	cfg.TwoFactorChallengeTTL = getDuration("TWO_FACTOR_CHALLENGE_TTL", cfg.TwoFactorChallengeTTL)
+	cfg.PasswordMinLength = getInt("PASSWORD_MIN_LENGTH", cfg.PasswordMinLength)
+	cfg.PasswordHasher = getEnv("PASSWORD_HASHER", cfg.PasswordHasher)
+	cfg.BcryptCost = getInt("BCRYPT_COST", cfg.BcryptCost)
+	cfg.LoginFreeAttempts = getInt("LOGIN_FREE_ATTEMPTS", cfg.LoginFreeAttempts)
+	cfg.LoginIPFreeAttempts = getInt("LOGIN_IP_FREE_ATTEMPTS", cfg.LoginIPFreeAttempts)
+	cfg.LoginBackoffBase = getDuration("LOGIN_BACKOFF_BASE", cfg.LoginBackoffBase)
+	cfg.LoginBackoffMax = getDuration("LOGIN_BACKOFF_MAX", cfg.LoginBackoffMax)
+	cfg.LoginLockoutThreshold = getInt("LOGIN_LOCKOUT_THRESHOLD", cfg.LoginLockoutThreshold)
+	cfg.LoginLockoutDuration = getDuration("LOGIN_LOCKOUT_DURATION", cfg.LoginLockoutDuration)
+	if secret := os.Getenv("CART_TOKEN_SECRET"); secret != "" {
+		cfg.CartTokenSecret = []byte(secret)
+	} else {
+		log.Println("CART_TOKEN_SECRET is not set; guest cart tokens will not survive a restart")
+	}
+	cfg.GuestCartTTL = getDuration("GUEST_CART_TTL", cfg.GuestCartTTL)
+	cfg.GuestCartSweepInterval = getDuration("GUEST_CART_SWEEP_INTERVAL", cfg.GuestCartSweepInterval)
+	cfg.CartShareTTL = getDuration("CART_SHARE_TTL", cfg.CartShareTTL)
+	cfg.PasswordResetTTL = getDuration("PASSWORD_RESET_TTL", cfg.PasswordResetTTL)
+	cfg.PasswordResetURL = getEnv("PASSWORD_RESET_URL", cfg.PasswordResetURL)
+	cfg.PasswordResetCooldown = getDuration("PASSWORD_RESET_COOLDOWN", cfg.PasswordResetCooldown)
+	cfg.MailDriver = getEnv("MAIL_DRIVER", cfg.MailDriver)
+	cfg.MailFrom = getEnv("MAIL_FROM", cfg.MailFrom)
+	cfg.MailOutboxDir = getEnv("MAIL_OUTBOX_DIR", cfg.MailOutboxDir)
+	cfg.SMTPAddr = os.Getenv("SMTP_ADDR")
+	cfg.SMTPUsername = os.Getenv("SMTP_USERNAME")
+	cfg.SMTPPassword = os.Getenv("SMTP_PASSWORD")
+	cfg.MailQueueInterval = getDuration("MAIL_QUEUE_INTERVAL", cfg.MailQueueInterval)
+	cfg.IdempotencyKeyTTL = getDuration("IDEMPOTENCY_KEY_TTL", cfg.IdempotencyKeyTTL)
+	cfg.StockHoldsEnabled = getBool("STOCK_HOLDS_ENABLED", cfg.StockHoldsEnabled)
+	cfg.StockHoldTTL = getDuration("STOCK_HOLD_TTL", cfg.StockHoldTTL)
+	cfg.StockHoldSweepInterval = getDuration("STOCK_HOLD_SWEEP_INTERVAL", cfg.StockHoldSweepInterval)
+
+	switch cfg.AuthMode {
+	case AuthModeOpaque:
+	case AuthModeJWT:
+		if len(cfg.JWTSecret) < 32 {
+			log.Fatal("JWT_SECRET must be at least 32 bytes when AUTH_MODE=jwt")
+		}
+	default:
+		log.Fatalf("Unknown AUTH_MODE %q, expected %q or %q", cfg.AuthMode, AuthModeOpaque, AuthModeJWT)
+	}
+
+	switch cfg.PasswordHasher {
+	case "bcrypt":
+		if cfg.BcryptCost < 4 || cfg.BcryptCost > 31 {
+			log.Fatalf("BCRYPT_COST must be between 4 and 31, got %d", cfg.BcryptCost)
+		}
+	case "argon2id":
+	default:
+		log.Fatalf("Unknown PASSWORD_HASHER %q, expected \"bcrypt\" or \"argon2id\"", cfg.PasswordHasher)
+	}
+
+	switch cfg.MailDriver {
+	case "outbox":
+	case "smtp":
+		if cfg.SMTPAddr == "" {
+			log.Fatal("SMTP_ADDR is required when MAIL_DRIVER=smtp")
+		}
+	default:
+		log.Fatalf("Unknown MAIL_DRIVER %q, expected \"outbox\" or \"smtp\"", cfg.MailDriver)
+	}
+
+	Current = cfg
+}
+
+func getEnv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid duration %q for %s, using %s", value, key, defaultValue)
+		return defaultValue
+	}
+	return duration
+}
+
+func getBool(key string, defaultValue bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid boolean %q for %s, using %t", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+func getInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid integer %q for %s, using %d", value, key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// randomSecret returns a key for signing tokens when none is configured.
+func randomSecret() []byte {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatal("Failed to generate secret:", err)
+	}
+	return secret
+}
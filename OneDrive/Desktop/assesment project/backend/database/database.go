@@ -4,12 +4,15 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 
+	"shopping-cart/auth"
+	"shopping-cart/config"
 	"shopping-cart/models"
 
 	"github.com/jinzhu/gorm"
-	_ "github.com/lib/pq"
 	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
 )
 
 var DB *gorm.DB
@@ -34,18 +37,160 @@ func InitDB() {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
+	// Hash or drop plaintext tokens left by older versions
+	migratePlaintextTokens()
+
 	// Auto-migrate all models
 	DB.AutoMigrate(
 		&models.User{},
+		&models.Session{},
+		&models.UsedRefreshToken{},
+		&models.PasswordResetToken{},
+		&models.RecoveryCode{},
+		&models.LoginChallenge{},
+		&models.AuditLog{},
+		&models.APIKey{},
 		&models.Item{},
 		&models.Cart{},
 		&models.CartItem{},
 		&models.Order{},
+		&models.OrderLine{},
+		&models.OrderTransition{},
+		&models.IdempotencyKey{},
+		&models.StockHold{},
+		&models.CartShare{},
+		&models.CartCollaborator{},
+		&models.CartChange{},
+		&models.Wishlist{},
+		&models.WishlistItem{},
+		&models.QueuedEmail{},
 	)
 
+	backfillOrderLines()
+	markGuestCarts()
+
 	log.Println("Database connected and migrated successfully")
 }
 
+// migratePlaintextTokens replaces plaintext session tokens with their
+// digest, so existing sessions keep working, and drops the single-token
+// column older versions kept on users. Those tokens were already unusable.
+func migratePlaintextTokens() {
+	if DB.HasTable(&models.Session{}) && DB.Dialect().HasColumn("sessions", "token") {
+		if !DB.Dialect().HasColumn("sessions", "token_hash") {
+			DB.Exec("ALTER TABLE sessions ADD COLUMN token_hash varchar(64)")
+		}
+
+		rows, err := DB.Table("sessions").Select("id, token").Rows()
+		if err != nil {
+			log.Fatal("Failed to read session tokens:", err)
+		}
+		tokens := map[uint]string{}
+		for rows.Next() {
+			var id uint
+			var token string
+			if err := rows.Scan(&id, &token); err != nil {
+				rows.Close()
+				log.Fatal("Failed to read session tokens:", err)
+			}
+			tokens[id] = token
+		}
+		rows.Close()
+
+		for id, token := range tokens {
+			DB.Table("sessions").Where("id = ?", id).UpdateColumn("token_hash", models.HashSessionToken(token))
+		}
+
+		if err := DB.Model(&models.Session{}).DropColumn("token").Error; err != nil {
+			log.Fatal("Failed to drop plaintext session tokens:", err)
+		}
+		log.Printf("Hashed %d plaintext session tokens", len(tokens))
+	}
+
+	if DB.HasTable(&models.User{}) && DB.Dialect().HasColumn("users", "token") {
+		if err := DB.Model(&models.User{}).DropColumn("token").Error; err != nil {
+			log.Fatal("Failed to drop plaintext user tokens:", err)
+		}
+		log.Println("Dropped plaintext user tokens")
+	}
+}
+
+// backfillOrderLines snapshots orders created before order lines and order
+// totals existed, using their cart as it looks at migration time. Every
+// processed order gets a total, so an order is only backfilled once.
+func backfillOrderLines() {
+	var orders []models.Order
+	DB.Where("total_currency IS NULL OR total_currency = ''").Preload("Lines").Find(&orders)
+
+	for _, order := range orders {
+		if err := backfillOrder(order); err != nil {
+			log.Printf("Failed to backfill order %d: %v", order.ID, err)
+		}
+	}
+}
+
+// backfillOrder snapshots the lines of an order that has none, then sets the
+// order's total from its lines. Orders whose cart is gone get a zero total.
+func backfillOrder(order models.Order) error {
+	tx := DB.Begin()
+
+	lines := order.Lines
+	if len(lines) == 0 {
+		var cart models.Cart
+		if err := tx.Where("id = ?", order.CartID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err == nil {
+			lines = models.OrderLinesFromCart(cart)
+		}
+		for i := range lines {
+			lines[i].OrderID = order.ID
+			lines[i].CreatedAt = order.CreatedAt
+			if err := tx.Create(&lines[i]).Error; err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	currency := models.DefaultCurrency
+	subtotals := make([]models.Money, 0, len(lines))
+	for _, line := range lines {
+		subtotals = append(subtotals, line.LineTotal)
+	}
+	if len(subtotals) > 0 {
+		currency = subtotals[0].Currency
+	}
+	total, err := models.Sum(currency, subtotals...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Model(&models.Order{}).Where("id = ?", order.ID).Updates(map[string]interface{}{
+		"total_amount":   total.Amount,
+		"total_currency": total.Currency,
+	}).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+// markGuestCarts flags the guest carts of older versions, which were told
+// apart only by their missing user_id, and gives them a full lifetime.
+// Deleted users' carts have no user_id either, but only their checked out
+// carts are kept.
+func markGuestCarts() {
+	result := DB.Model(&models.Cart{}).
+		Where("user_id = ? AND status = ? AND (guest = ? OR expires_at IS NULL)", models.DeletedUserID, models.CartStatusActive, false).
+		Updates(map[string]interface{}{"guest": true, "expires_at": time.Now().Add(config.Current.GuestCartTTL)})
+	if result.Error != nil {
+		log.Fatal("Failed to mark guest carts:", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Marked %d guest carts", result.RowsAffected)
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
 	if value == "" {
@@ -65,11 +210,11 @@ func SeedData() {
 
 	// Seed sample items
 	items := []models.Item{
-		{Name: "Laptop", Status: "active"},
-		{Name: "Mouse", Status: "active"},
-		{Name: "Keyboard", Status: "active"},
-		{Name: "Monitor", Status: "active"},
-		{Name: "Headphones", Status: "active"},
+		{Name: "Laptop", Status: "active", Price: 99900, Currency: models.DefaultCurrency, Stock: stock(10)},
+		{Name: "Mouse", Status: "active", Price: 2500, Currency: models.DefaultCurrency, Stock: stock(100)},
+		{Name: "Keyboard", Status: "active", Price: 4999, Currency: models.DefaultCurrency, Stock: stock(50)},
+		{Name: "Monitor", Status: "active", Price: 18900, Currency: models.DefaultCurrency, Stock: stock(25)},
+		{Name: "Headphones", Status: "active", Price: 7950, Currency: models.DefaultCurrency, Stock: stock(40)},
 	}
 
 	for _, item := range items {
@@ -79,3 +224,76 @@ func SeedData() {
 	log.Println("Database seeded with sample items")
 }
 
+// SeedAdmin creates an admin account with the given credentials unless a
+// user with that username already exists.
+func SeedAdmin(username, password string) {
+	var count int
+	DB.Model(&models.User{}).Where("username = ?", username).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	hasher := auth.PasswordHasher{Algorithm: config.Current.PasswordHasher, BcryptCost: config.Current.BcryptCost}
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		log.Println("Failed to hash admin password:", err)
+		return
+	}
+
+	admin := models.User{
+		Username:  username,
+		Password:  hashedPassword,
+		Role:      models.RoleAdmin,
+		CreatedAt: time.Now(),
+	}
+	if err := DB.Create(&admin).Error; err != nil {
+		log.Println("Failed to create admin user:", err)
+		return
+	}
+
+	log.Printf("Created admin user %s", username)
+}
+
+// ReleaseExpiredStockHolds deletes stock holds whose time has run out.
+func ReleaseExpiredStockHolds() {
+	result := DB.Where("expires_at <= ?", time.Now()).Delete(&models.StockHold{})
+	if result.Error != nil {
+		log.Println("Failed to release expired stock holds:", result.Error)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Released %d expired stock holds", result.RowsAffected)
+	}
+}
+
+// DeleteExpiredGuestCarts deletes guest carts whose token has run out, with
+// their lines, holds and change log.
+func DeleteExpiredGuestCarts() {
+	expired := DB.Model(&models.Cart{}).Select("id").Where("guest = ? AND expires_at <= ?", true, time.Now()).QueryExpr()
+
+	tx := DB.Begin()
+	for _, model := range []interface{}{&models.StockHold{}, &models.CartItem{}, &models.CartChange{}} {
+		if err := tx.Where("cart_id IN (?)", expired).Delete(model).Error; err != nil {
+			tx.Rollback()
+			log.Println("Failed to delete expired guest carts:", err)
+			return
+		}
+	}
+	result := tx.Where("id IN (?)", expired).Delete(&models.Cart{})
+	if result.Error != nil {
+		tx.Rollback()
+		log.Println("Failed to delete expired guest carts:", result.Error)
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		log.Println("Failed to delete expired guest carts:", err)
+		return
+	}
+	if result.RowsAffected > 0 {
+		log.Printf("Deleted %d expired guest carts", result.RowsAffected)
+	}
+}
+
+func stock(quantity int) *int {
+	return &quantity
+}
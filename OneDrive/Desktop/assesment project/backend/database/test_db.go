@@ -17,13 +17,33 @@ func InitTestDB() {
 		log.Fatal("Failed to connect to test database:", err)
 	}
 
+	// Every connection to ":memory:" opens a separate empty database, so keep
+	// the whole test run on a single connection
+	DB.DB().SetMaxOpenConns(1)
+
 	// Auto-migrate all models
 	DB.AutoMigrate(
 		&models.User{},
+		&models.Session{},
+		&models.UsedRefreshToken{},
+		&models.PasswordResetToken{},
+		&models.RecoveryCode{},
+		&models.LoginChallenge{},
+		&models.AuditLog{},
+		&models.APIKey{},
 		&models.Item{},
 		&models.Cart{},
 		&models.CartItem{},
 		&models.Order{},
+		&models.OrderLine{},
+		&models.OrderTransition{},
+		&models.IdempotencyKey{},
+		&models.StockHold{},
+		&models.CartShare{},
+		&models.CartCollaborator{},
+		&models.CartChange{},
+		&models.Wishlist{},
+		&models.WishlistItem{},
+		&models.QueuedEmail{},
 	)
 }
-
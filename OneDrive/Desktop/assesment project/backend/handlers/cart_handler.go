@@ -1,19 +1,62 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"shopping-cart/database"
 	"shopping-cart/models"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 )
 
 type CreateCartRequest struct {
 	ItemIDs []uint `json:"item_ids"`
 }
 
+// Outcomes of a requested item in CreateCart
+const (
+	CartItemAdded          = "added"
+	CartItemAlreadyPresent = "already_present"
+	CartItemNotFound       = "not_found"
+	CartItemInactive       = "inactive"
+)
+
+// CartItemResult reports what happened to one requested item. Quantity is
+// the line's quantity after the request, for items that were added.
+type CartItemResult struct {
+	ItemID   uint   `json:"item_id"`
+	Status   string `json:"status"`
+	Quantity int    `json:"quantity,omitempty"`
+}
+
+// CartResponse is a cart with the outcome of every item the request asked
+// to add, in request order.
+type CartResponse struct {
+	models.Cart
+	Results []CartItemResult `json:"results"`
+}
+
+// CreateNamedCartRequest creates an extra cart. The user's first cart, or
+// any cart created with Activate, becomes the active cart.
+type CreateNamedCartRequest struct {
+	Name     string `json:"name" binding:"required"`
+	Activate bool   `json:"activate"`
+}
+
+type RenameCartRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+type UpdateCartItemRequest struct {
+	Quantity *int `json:"quantity" binding:"required"`
+}
+
 func CreateCart(c *gin.Context) {
 	user, exists := c.Get("user")
 	if !exists {
@@ -29,75 +72,52 @@ func CreateCart(c *gin.Context) {
 		return
 	}
 
-	// Check if user already has an active cart
-	var cart models.Cart
-	if currentUser.CartID != nil {
-		// User has a cart, use it
-		if err := database.DB.Where("id = ?", *currentUser.CartID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err != nil {
-			// Cart doesn't exist, create new one
-			cart = models.Cart{
-				UserID:    currentUser.ID,
-				Name:      "My Cart",
-				Status:    "active",
-				CreatedAt: time.Now(),
-			}
-			if err := database.DB.Create(&cart).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
-				return
-			}
-			currentUser.CartID = &cart.ID
-			database.DB.Save(currentUser)
-		}
-	} else {
-		// User has no cart, create new one
-		cart = models.Cart{
-			UserID:    currentUser.ID,
-			Name:      "My Cart",
-			Status:    "active",
-			CreatedAt: time.Now(),
-		}
-		if err := database.DB.Create(&cart).Error; err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
-			return
-		}
-		currentUser.CartID = &cart.ID
-		database.DB.Save(currentUser)
+	tx := database.DB.Begin()
+
+	cart, err := userCart(tx, currentUser)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
+		return
 	}
 
-	// Add items to cart
-	for _, itemID := range req.ItemIDs {
-		// Check if item exists
-		var item models.Item
-		if err := database.DB.First(&item, itemID).Error; err != nil {
-			continue // Skip invalid items
-		}
+	results, ok := addCartItems(c, tx, cart, req.ItemIDs)
+	if !ok {
+		tx.Rollback()
+		return
+	}
 
-		// Check if item already in cart
-		var existingCartItem models.CartItem
-		if err := database.DB.Where("cart_id = ? AND item_id = ?", cart.ID, itemID).First(&existingCartItem).Error; err != nil {
-			// Item not in cart, add it
-			cartItem := models.CartItem{
-				CartID: cart.ID,
-				ItemID: itemID,
-			}
-			database.DB.Create(&cartItem)
-		}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
 	}
 
 	// Reload cart with items
-	database.DB.Where("id = ?", cart.ID).Preload("CartItems").Preload("CartItems.Item").First(&cart)
+	cart, _ = loadCart(cart.ID)
 
-	c.JSON(http.StatusOK, cart)
+	c.JSON(http.StatusOK, CartResponse{cart, results})
 }
 
 func ListCarts(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
 	var carts []models.Cart
-	query := database.DB.Preload("CartItems").Preload("CartItems.Item").Preload("User")
+	query := database.DB.Preload("CartItems").Preload("CartItems.Item").Preload("User").Where("guest = ?", false)
 
-	// Optional filtering by user_id
-	userID := c.Query("user_id")
-	if userID != "" {
-		query = query.Where("user_id = ?", userID)
+	// Staff may see every cart, optionally filtered by user_id; everyone else
+	// only sees their own
+	if currentUser.Can(models.PermCartsReadAll) {
+		if userID := c.Query("user_id"); userID != "" {
+			query = query.Where("user_id = ?", userID)
+		}
+	} else {
+		query = query.Where("user_id = ?", currentUser.ID)
 	}
 
 	if err := query.Find(&carts).Error; err != nil {
@@ -105,6 +125,12 @@ func ListCarts(c *gin.Context) {
 		return
 	}
 
+	for i := range carts {
+		carts[i].ComputeTotals()
+		carts[i].Revalidate()
+		carts[i].Active = carts[i].User != nil && carts[i].User.CartID != nil && *carts[i].User.CartID == carts[i].ID
+	}
+
 	c.JSON(http.StatusOK, carts)
 }
 
@@ -122,8 +148,8 @@ func GetUserCart(c *gin.Context) {
 		return
 	}
 
-	var cart models.Cart
-	if err := database.DB.Where("id = ?", *currentUser.CartID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err != nil {
+	cart, err := loadCart(*currentUser.CartID)
+	if err != nil {
 		c.JSON(http.StatusOK, gin.H{"message": "Cart not found", "cart": nil})
 		return
 	}
@@ -131,3 +157,727 @@ func GetUserCart(c *gin.Context) {
 	c.JSON(http.StatusOK, cart)
 }
 
+func UpdateCartItem(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
+	updateCartLine(c, currentUser.CartID)
+}
+
+func RemoveCartItem(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
+	removeCartLine(c, currentUser.CartID)
+}
+
+// AddCartItemsByID adds items to a cart by ID, for its owner and
+// collaborators with edit access.
+func AddCartItemsByID(c *gin.Context) {
+	var req CreateCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	cart, ok := findOpenCart(c, user.(*models.User))
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Where("id = ?", cart.ID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	results, ok := addCartItems(c, tx, cart, req.ItemIDs)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, CartResponse{cart, results})
+}
+
+func UpdateCartItemByID(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findOpenCart(c, user.(*models.User))
+	if !ok {
+		return
+	}
+
+	updateCartLine(c, &cart.ID)
+}
+
+func RemoveCartItemByID(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findOpenCart(c, user.(*models.User))
+	if !ok {
+		return
+	}
+
+	removeCartLine(c, &cart.ID)
+}
+
+// ListSharedCarts lists the carts other users invited the current user to.
+func ListSharedCarts(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	invited := database.DB.Model(&models.CartCollaborator{}).Select("cart_id").Where("user_id = ?", currentUser.ID).QueryExpr()
+
+	var carts []models.Cart
+	if err := database.DB.Where("id IN (?)", invited).Preload("CartItems").Preload("CartItems.Item").Preload("Owner").Order("id").Find(&carts).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch carts"})
+		return
+	}
+
+	for i := range carts {
+		carts[i].ComputeTotals()
+		carts[i].Revalidate()
+	}
+
+	c.JSON(http.StatusOK, carts)
+}
+
+// CreateNamedCart creates another open cart for the user.
+func CreateNamedCart(c *gin.Context) {
+	var req CreateNamedCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, ok := checkCartName(c, req.Name)
+	if !ok {
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart := models.Cart{
+		UserID:    currentUser.ID,
+		Name:      name,
+		Status:    models.CartStatusActive,
+		CreatedAt: time.Now(),
+	}
+	if err := database.DB.Create(&cart).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
+		return
+	}
+
+	if req.Activate || currentUser.CartID == nil {
+		if err := database.DB.Model(&models.User{}).Where("id = ?", currentUser.ID).Update("cart_id", cart.ID).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate cart"})
+			return
+		}
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusCreated, cart)
+}
+
+// GetCart returns a cart by ID to its owner and collaborators. Staff may
+// read any cart.
+func GetCart(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, models.CartAccessView)
+	if !ok {
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func RenameCart(c *gin.Context) {
+	var req RenameCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, ok := checkCartName(c, req.Name)
+	if !ok {
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	if err := database.DB.Model(&models.Cart{}).Where("id = ?", cart.ID).Update("name", name).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rename cart"})
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// DeleteCart deletes an open cart with its lines, stock holds, share links,
+// collaborators and change log. Carts that were checked out are kept with
+// their orders.
+func DeleteCart(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	if !cart.IsOpen() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	// Claim the cart first so a concurrent checkout cannot order it while
+	// its lines are deleted
+	result := tx.Where("id = ? AND status = ?", cart.ID, models.CartStatusActive).Delete(&models.Cart{})
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+		return
+	}
+	if err := tx.Where("cart_id = ?", cart.ID).Delete(&models.StockHold{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
+		return
+	}
+	if err := tx.Where("cart_id = ?", cart.ID).Delete(&models.CartItem{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
+		return
+	}
+	for _, record := range []interface{}{&models.CartShare{}, &models.CartCollaborator{}, &models.CartChange{}} {
+		if err := tx.Where("cart_id = ?", cart.ID).Delete(record).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
+			return
+		}
+	}
+	if err := tx.Model(&models.User{}).Where("id = ? AND cart_id = ?", currentUser.ID, cart.ID).Update("cart_id", gorm.Expr("NULL")).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear user cart"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete cart"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Cart deleted"})
+}
+
+// ActivateCart makes one of the user's open carts the active cart, the one
+// the /carts/me routes and POST /carts work on.
+func ActivateCart(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	if !cart.IsOpen() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+		return
+	}
+
+	if err := database.DB.Model(&models.User{}).Where("id = ?", currentUser.ID).Update("cart_id", cart.ID).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to activate cart"})
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// Access levels on a cart, from least to most
+var cartAccessRank = map[string]int{
+	models.CartAccessView: 1,
+	models.CartAccessEdit: 2,
+	cartAccessOwner:       3,
+}
+
+const cartAccessOwner = "owner"
+
+// cartAccess returns the access user has to cart: owner, the access of a
+// collaborator, view for staff who may read every cart, or "" for none.
+func cartAccess(user *models.User, cart models.Cart) (string, error) {
+	if cart.UserID == user.ID {
+		return cartAccessOwner, nil
+	}
+
+	var collaborator models.CartCollaborator
+	err := database.DB.Where("cart_id = ? AND user_id = ?", cart.ID, user.ID).First(&collaborator).Error
+	if err == nil {
+		return collaborator.Access, nil
+	}
+	if !gorm.IsRecordNotFoundError(err) {
+		return "", err
+	}
+
+	if user.Can(models.PermCartsReadAll) {
+		return models.CartAccessView, nil
+	}
+	return "", nil
+}
+
+// findCart loads the cart named by the id parameter and checks the user has
+// at least the access named by need. Carts the user cannot see are reported
+// as not found.
+func findCart(c *gin.Context, user *models.User, need string) (models.Cart, bool) {
+	var cart models.Cart
+	cartID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cart ID"})
+		return cart, false
+	}
+
+	// Guest carts have no owner to share them
+	if err := database.DB.Where("id = ? AND guest = ?", cartID, false).First(&cart).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return cart, false
+	}
+
+	access, err := cartAccess(user, cart)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check cart access"})
+		return cart, false
+	}
+	if access == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return cart, false
+	}
+	if cartAccessRank[access] < cartAccessRank[need] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient access to this cart"})
+		return cart, false
+	}
+	return cart, true
+}
+
+// findOpenCart is findCart for changing a cart's lines: it needs edit
+// access and an open cart.
+func findOpenCart(c *gin.Context, user *models.User) (models.Cart, bool) {
+	cart, ok := findCart(c, user, models.CartAccessEdit)
+	if !ok {
+		return cart, false
+	}
+	if !cart.IsOpen() {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+		return cart, false
+	}
+	return cart, true
+}
+
+func checkCartName(c *gin.Context, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart name cannot be empty"})
+		return "", false
+	}
+	if len(name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart name must be at most 100 characters"})
+		return "", false
+	}
+	return name, true
+}
+
+// userCart returns the user's active cart, creating it when the user has
+// none.
+func userCart(db *gorm.DB, user *models.User) (models.Cart, error) {
+	var cart models.Cart
+	if user.CartID != nil {
+		if err := db.Where("id = ?", *user.CartID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err == nil {
+			return cart, nil
+		}
+	}
+
+	cart = models.Cart{
+		UserID:    user.ID,
+		Name:      models.DefaultCartName,
+		Status:    models.CartStatusActive,
+		CreatedAt: time.Now(),
+	}
+	if err := db.Create(&cart).Error; err != nil {
+		return cart, err
+	}
+	user.CartID = &cart.ID
+	db.Model(user).Update("cart_id", cart.ID)
+	return cart, nil
+}
+
+// addCartItems adds one unit of each requested item to the cart and reports
+// the outcome per item. Unknown and inactive items are skipped, or with
+// ?strict=true fail the request with 422. Items priced in another currency
+// than the cart always fail the request. On failure the response is written
+// and the caller must roll back db, which undoes the items already added.
+func addCartItems(c *gin.Context, db *gorm.DB, cart models.Cart, itemIDs []uint) ([]CartItemResult, bool) {
+	strict, _ := strconv.ParseBool(c.Query("strict"))
+
+	results := make([]CartItemResult, len(itemIDs))
+	rejected := false
+
+	for i, itemID := range itemIDs {
+		results[i].ItemID = itemID
+
+		var item models.Item
+		if err := db.First(&item, itemID).Error; err != nil {
+			results[i].Status, rejected = CartItemNotFound, true
+			continue
+		}
+
+		line, added, err := addCartLine(db, requestActor(c), cart.ID, item, 1)
+		if err == errItemInactive {
+			results[i].Status, rejected = CartItemInactive, true
+			continue
+		}
+		if err != nil {
+			writeCartLineError(c, item, err)
+			return nil, false
+		}
+		results[i].Status = CartItemAlreadyPresent
+		if added {
+			results[i].Status = CartItemAdded
+		}
+		results[i].Quantity = line.Quantity
+	}
+
+	if strict && rejected {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Some items cannot be added", "results": results})
+		return nil, false
+	}
+	return results, true
+}
+
+// updateCartLine sets the quantity of the item_id line in the cart and
+// writes the updated cart. A nil cartID means there is no cart to update.
+func updateCartLine(c *gin.Context, cartID *uint) {
+	itemID, err := strconv.ParseUint(c.Param("item_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	var req UpdateCartItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if *req.Quantity < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity cannot be negative"})
+		return
+	}
+	if *req.Quantity > models.MaxLineQuantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": quantityTooLarge})
+		return
+	}
+
+	if cartID == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active cart"})
+		return
+	}
+
+	var cartItem models.CartItem
+	if err := database.DB.Where("cart_id = ? AND item_id = ?", *cartID, itemID).First(&cartItem).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := setCartLineQuantity(tx, requestActor(c), cartItem, *req.Quantity); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
+		return
+	}
+
+	cart, _ := loadCart(*cartID)
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// removeCartLine deletes the item_id line from the cart and writes the
+// updated cart. A nil cartID means there is no cart to update.
+func removeCartLine(c *gin.Context, cartID *uint) {
+	itemID, err := strconv.ParseUint(c.Param("item_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	if cartID == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active cart"})
+		return
+	}
+
+	var cartItem models.CartItem
+	if err := database.DB.Where("cart_id = ? AND item_id = ?", *cartID, itemID).First(&cartItem).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := setCartLineQuantity(tx, requestActor(c), cartItem, 0); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from cart"})
+		return
+	}
+
+	cart, _ := loadCart(*cartID)
+
+	c.JSON(http.StatusOK, cart)
+}
+
+// cartActor is who changes a cart: a user, or a share link for edits made
+// through one. Guests act as user 0.
+type cartActor struct {
+	UserID  uint
+	ShareID *uint
+}
+
+// requestActor returns the actor behind the request.
+func requestActor(c *gin.Context) cartActor {
+	actor := cartActor{UserID: c.GetUint("user_id")}
+	if shareID := c.GetUint("cart_share_id"); shareID != 0 {
+		actor.ShareID = &shareID
+	}
+	return actor
+}
+
+// addCartLine adds quantity units of item to the cart, summing with the
+// line already in the cart, and syncs the cart's stock hold. added reports
+// whether a new line was created. Items that are not active fail with
+// errItemInactive, items priced in another currency than the cart with a
+// currencyMismatchError, and lines that would exceed MaxLineQuantity with
+// errQuantityTooLarge.
+func addCartLine(db *gorm.DB, actor cartActor, cartID uint, item models.Item, quantity int) (line models.CartItem, added bool, err error) {
+	if !item.IsActive() {
+		return line, false, errItemInactive
+	}
+
+	// A cart total is only meaningful in a single currency
+	currency, err := cartCurrency(db, cartID, item.ID)
+	if err != nil {
+		return line, false, err
+	}
+	if currency != "" && item.UnitPrice().Currency != currency {
+		return line, false, currencyMismatchError{item, currency}
+	}
+
+	action := models.CartChangeUpdated
+	if err := db.Where("cart_id = ? AND item_id = ?", cartID, item.ID).First(&line).Error; err != nil {
+		if quantity > models.MaxLineQuantity {
+			return line, false, errQuantityTooLarge
+		}
+		line = models.CartItem{
+			CartID:     cartID,
+			ItemID:     item.ID,
+			Quantity:   quantity,
+			AddedPrice: item.UnitPrice(),
+		}
+		added, action = true, models.CartChangeAdded
+		err = db.Create(&line).Error
+	} else {
+		if line.Quantity+quantity > models.MaxLineQuantity {
+			return line, false, errQuantityTooLarge
+		}
+		// Adding the item again accepts its current price
+		line.Quantity += quantity
+		line.AddedPrice = item.UnitPrice()
+		err = db.Model(&models.CartItem{}).Where("id = ?", line.ID).Updates(cartLineUpdates(line)).Error
+	}
+	if err != nil {
+		return line, added, err
+	}
+
+	if err := recordCartChange(db, actor, cartID, item.ID, action, line.Quantity); err != nil {
+		return line, added, err
+	}
+	return line, added, syncStockHold(db, cartID, item, line.Quantity)
+}
+
+// cartCurrency returns the currency of the cart's lines other than the one
+// for excludeItemID, or "" when there are none.
+func cartCurrency(db *gorm.DB, cartID, excludeItemID uint) (string, error) {
+	var line models.CartItem
+	err := db.Where("cart_id = ? AND item_id <> ?", cartID, excludeItemID).Preload("Item").First(&line).Error
+	if gorm.IsRecordNotFoundError(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return line.Item.UnitPrice().Currency, nil
+}
+
+// setCartLineQuantity changes the quantity of a cart line at the item's
+// current price, logs the change and syncs the line's stock hold. A quantity
+// of zero removes the line. Run it in a transaction so the three writes
+// succeed or fail together.
+func setCartLineQuantity(db *gorm.DB, actor cartActor, line models.CartItem, quantity int) error {
+	if quantity == 0 {
+		if err := db.Delete(&line).Error; err != nil {
+			return err
+		}
+		if err := recordCartChange(db, actor, line.CartID, line.ItemID, models.CartChangeRemoved, 0); err != nil {
+			return err
+		}
+		return releaseStockHold(db, line.CartID, line.ItemID)
+	}
+
+	var item models.Item
+	if err := db.First(&item, line.ItemID).Error; err != nil {
+		return err
+	}
+
+	// Changing the quantity accepts the item's current price
+	line.Quantity = quantity
+	line.AddedPrice = item.UnitPrice()
+	if err := db.Model(&models.CartItem{}).Where("id = ?", line.ID).Updates(cartLineUpdates(line)).Error; err != nil {
+		return err
+	}
+	if err := recordCartChange(db, actor, line.CartID, line.ItemID, models.CartChangeUpdated, quantity); err != nil {
+		return err
+	}
+	return syncStockHold(db, line.CartID, item, quantity)
+}
+
+// cartLineUpdates returns the columns of line that change when units are
+// added or its quantity is set.
+func cartLineUpdates(line models.CartItem) map[string]interface{} {
+	return map[string]interface{}{
+		"quantity":             line.Quantity,
+		"added_price_amount":   line.AddedPrice.Amount,
+		"added_price_currency": line.AddedPrice.Currency,
+	}
+}
+
+func recordCartChange(db *gorm.DB, actor cartActor, cartID, itemID uint, action string, quantity int) error {
+	return db.Create(&models.CartChange{
+		CartID:    cartID,
+		ItemID:    itemID,
+		Action:    action,
+		Quantity:  quantity,
+		ActorID:   actor.UserID,
+		ShareID:   actor.ShareID,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+var errItemInactive = errors.New("item is not active")
+
+var errQuantityTooLarge = errors.New("quantity exceeds the line maximum")
+
+var quantityTooLarge = fmt.Sprintf("Quantity cannot be more than %d", models.MaxLineQuantity)
+
+// currencyMismatchError rejects an item priced in another currency than the
+// cart it is added to.
+type currencyMismatchError struct {
+	item     models.Item
+	currency string
+}
+
+func (e currencyMismatchError) Error() string {
+	return currencyMismatch(e.item, e.currency)
+}
+
+func currencyMismatch(item models.Item, currency string) string {
+	return "Item " + item.Name + " is priced in " + item.Currency + " but the cart is priced in " + currency
+}
+
+// writeCartLineError answers a request whose addCartLine for item failed
+// with err.
+func writeCartLineError(c *gin.Context, item models.Item, err error) {
+	var mismatch currencyMismatchError
+	switch {
+	case err == errItemInactive:
+		c.JSON(http.StatusConflict, gin.H{"error": "Item " + item.Name + " is not available"})
+	case err == errQuantityTooLarge:
+		c.JSON(http.StatusBadRequest, gin.H{"error": quantityTooLarge})
+	case errors.As(err, &mismatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to cart"})
+	}
+}
+
+// loadCart fetches a cart with its items and fills in the computed totals,
+// the issues found by revalidating its lines, and stock warnings.
+func loadCart(cartID uint) (models.Cart, error) {
+	var cart models.Cart
+	if err := database.DB.Where("id = ?", cartID).Preload("CartItems").Preload("CartItems.Item").First(&cart).Error; err != nil {
+		return cart, err
+	}
+	cart.ComputeTotals()
+	cart.Revalidate()
+
+	var owners int
+	database.DB.Model(&models.User{}).Where("cart_id = ?", cart.ID).Count(&owners)
+	cart.Active = owners > 0
+
+	// Stock warnings are measured against what other carts leave available
+	items := make([]*models.Item, len(cart.CartItems))
+	for i := range cart.CartItems {
+		items[i] = &cart.CartItems[i].Item
+	}
+	if err := applyAvailability(database.DB, items, cart.ID); err != nil {
+		return cart, err
+	}
+	cart.CheckStock()
+	return cart, nil
+}
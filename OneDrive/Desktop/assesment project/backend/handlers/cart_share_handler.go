@@ -0,0 +1,347 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateCartShareRequest creates a share link. ExpiresAt defaults to
+// CART_SHARE_TTL from now.
+type CreateCartShareRequest struct {
+	Access    string     `json:"access" binding:"required"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type AddCartCollaboratorRequest struct {
+	Username string `json:"username" binding:"required"`
+	Access   string `json:"access" binding:"required"`
+}
+
+// CreateCartShare creates a share link for one of the user's carts. The
+// token is only returned here; the server keeps its digest.
+func CreateCartShare(c *gin.Context) {
+	var req CreateCartShareRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !models.IsValidCartAccess(req.Access) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Access must be view or edit"})
+		return
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(config.Current.CartShareTTL)
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(now) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+			return
+		}
+		expiresAt = *req.ExpiresAt
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	share := models.CartShare{
+		CartID:      cart.ID,
+		TokenHash:   models.HashSessionToken(token),
+		Access:      req.Access,
+		CreatedByID: currentUser.ID,
+		ExpiresAt:   expiresAt,
+		CreatedAt:   now,
+	}
+	if err := database.DB.Create(&share).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token": token,
+		"path":  "/shared-carts/" + token,
+		"share": share,
+	})
+}
+
+// ListCartShares lists a cart's share links that have not expired.
+func ListCartShares(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findCart(c, user.(*models.User), cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	var shares []models.CartShare
+	if err := database.DB.Where("cart_id = ? AND expires_at > ?", cart.ID, time.Now()).Order("id").Find(&shares).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share links"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+func RevokeCartShare(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findCart(c, user.(*models.User), cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Where("id = ? AND cart_id = ?", c.Param("share_id"), cart.ID).Delete(&models.CartShare{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// AddCartCollaborator invites a user to a cart, or changes the access of a
+// user who is already a collaborator.
+func AddCartCollaborator(c *gin.Context) {
+	var req AddCartCollaboratorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !models.IsValidCartAccess(req.Access) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Access must be view or edit"})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	cart, ok := findCart(c, currentUser, cartAccessOwner)
+	if !ok {
+		return
+	}
+
+	var invitee models.User
+	if err := database.DB.Where("username = ?", strings.TrimSpace(req.Username)).First(&invitee).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if invitee.ID == currentUser.ID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You already own this cart"})
+		return
+	}
+
+	status := http.StatusOK
+	var collaborator models.CartCollaborator
+	if err := database.DB.Where("cart_id = ? AND user_id = ?", cart.ID, invitee.ID).First(&collaborator).Error; err != nil {
+		collaborator = models.CartCollaborator{
+			CartID:      cart.ID,
+			UserID:      invitee.ID,
+			Access:      req.Access,
+			InvitedByID: currentUser.ID,
+			CreatedAt:   time.Now(),
+		}
+		if err := database.DB.Create(&collaborator).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add collaborator"})
+			return
+		}
+		status = http.StatusCreated
+	} else if err := database.DB.Model(&collaborator).Update("access", req.Access).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collaborator"})
+		return
+	}
+
+	database.DB.Where("id = ?", collaborator.ID).Preload("User").First(&collaborator)
+
+	c.JSON(status, collaborator)
+}
+
+// ListCartCollaborators lists the users invited to a cart. Everyone who can
+// see the cart can see who else works on it.
+func ListCartCollaborators(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findCart(c, user.(*models.User), models.CartAccessView)
+	if !ok {
+		return
+	}
+
+	var collaborators []models.CartCollaborator
+	if err := database.DB.Where("cart_id = ?", cart.ID).Preload("User").Order("id").Find(&collaborators).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch collaborators"})
+		return
+	}
+
+	c.JSON(http.StatusOK, collaborators)
+}
+
+// RemoveCartCollaborator removes a collaborator. The owner can remove
+// anyone; collaborators can remove themselves.
+func RemoveCartCollaborator(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	need := cartAccessOwner
+	if c.Param("user_id") == strconv.FormatUint(uint64(currentUser.ID), 10) {
+		need = models.CartAccessView
+	}
+
+	cart, ok := findCart(c, currentUser, need)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Where("cart_id = ? AND user_id = ?", cart.ID, c.Param("user_id")).Delete(&models.CartCollaborator{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove collaborator"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collaborator not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collaborator removed"})
+}
+
+// ListCartChanges returns a cart's change log, newest first.
+func ListCartChanges(c *gin.Context) {
+	user, _ := c.Get("user")
+	cart, ok := findCart(c, user.(*models.User), models.CartAccessView)
+	if !ok {
+		return
+	}
+
+	var changes []models.CartChange
+	if err := database.DB.Where("cart_id = ?", cart.ID).Order("id DESC").Find(&changes).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch cart changes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// GetSharedCart returns the cart behind a share link.
+func GetSharedCart(c *gin.Context) {
+	share, ok := findCartShare(c, models.CartAccessView)
+	if !ok {
+		return
+	}
+
+	cart, err := loadCart(share.CartID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access":     share.Access,
+		"expires_at": share.ExpiresAt,
+		"cart":       cart,
+	})
+}
+
+func AddSharedCartItems(c *gin.Context) {
+	var req CreateCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	share, ok := findCartShare(c, models.CartAccessEdit)
+	if !ok {
+		return
+	}
+
+	cart, err := loadCart(share.CartID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	results, ok := addCartItems(c, tx, cart, req.ItemIDs)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, CartResponse{cart, results})
+}
+
+func UpdateSharedCartItem(c *gin.Context) {
+	share, ok := findCartShare(c, models.CartAccessEdit)
+	if !ok {
+		return
+	}
+
+	updateCartLine(c, &share.CartID)
+}
+
+func RemoveSharedCartItem(c *gin.Context) {
+	share, ok := findCartShare(c, models.CartAccessEdit)
+	if !ok {
+		return
+	}
+
+	removeCartLine(c, &share.CartID)
+}
+
+// findCartShare resolves the share link in the token parameter and checks
+// it grants the access named by need. Edits also need the cart to be open.
+// Changes made through the link are recorded against it.
+func findCartShare(c *gin.Context, need string) (models.CartShare, bool) {
+	var share models.CartShare
+	if err := database.DB.Where("token_hash = ? AND expires_at > ?", models.HashSessionToken(c.Param("token")), time.Now()).First(&share).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found or expired"})
+		return share, false
+	}
+
+	if cartAccessRank[share.Access] < cartAccessRank[need] {
+		c.JSON(http.StatusForbidden, gin.H{"error": "This share link is read-only"})
+		return share, false
+	}
+
+	if need == models.CartAccessEdit {
+		var cart models.Cart
+		if err := database.DB.Where("id = ?", share.CartID).First(&cart).Error; err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found"})
+			return share, false
+		}
+		if !cart.IsOpen() {
+			c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+			return share, false
+		}
+	}
+
+	c.Set("cart_share_id", share.ID)
+	return share, true
+}
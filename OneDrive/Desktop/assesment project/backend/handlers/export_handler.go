@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// UserExport is everything stored about a user, as handed out for a data
+// subject access request.
+type UserExport struct {
+	ExportedAt time.Time         `json:"exported_at"`
+	Profile    models.User       `json:"profile"`
+	Sessions   []models.Session  `json:"sessions"`
+	Carts      []models.Cart     `json:"carts"`
+	Wishlists  []models.Wishlist `json:"wishlists"`
+	Orders     []models.Order    `json:"orders"`
+}
+
+// ExportMyData exports the current user's data.
+func ExportMyData(c *gin.Context) {
+	user, _ := c.Get("user")
+	exportUserData(c, user.(*models.User).ID)
+}
+
+// ExportUserData exports the data of any user, for admins answering a
+// request on the user's behalf.
+func ExportUserData(c *gin.Context) {
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	exportUserData(c, user.ID)
+}
+
+// exportUserData writes the export of userID as a JSON document, or with
+// ?format=zip as a zip archive holding one JSON file per section. Every
+// export is recorded in the audit log.
+func exportUserData(c *gin.Context, userID uint) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "zip" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown export format: " + format})
+		return
+	}
+
+	export, err := buildUserExport(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to collect user data"})
+		return
+	}
+
+	var body []byte
+	var contentType string
+	if format == "zip" {
+		body, err = zipUserExport(export)
+		contentType = "application/zip"
+	} else {
+		body, err = json.MarshalIndent(export, "", "  ")
+		contentType = "application/json"
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build export"})
+		return
+	}
+
+	actorID := c.GetUint("user_id")
+	audit := models.AuditLog{
+		ActorID:       actorID,
+		Action:        models.AuditActionUserExport,
+		SubjectUserID: userID,
+		Details:       "format=" + format,
+		IPAddress:     c.ClientIP(),
+		CreatedAt:     export.ExportedAt,
+	}
+	if err := database.DB.Create(&audit).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record export"})
+		return
+	}
+
+	filename := fmt.Sprintf("user-%d-export-%s.%s", userID, export.ExportedAt.Format("20060102T150405Z"), format)
+	c.Header("Content-Disposition", `attachment; filename="`+filename+`"`)
+	c.Data(http.StatusOK, contentType, body)
+}
+
+func buildUserExport(userID uint) (*UserExport, error) {
+	export := &UserExport{ExportedAt: time.Now().UTC()}
+
+	if err := database.DB.Where("id = ?", userID).First(&export.Profile).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Where("user_id = ?", userID).Order("id").Find(&export.Sessions).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Preload("CartItems").Preload("CartItems.Item").Where("user_id = ?", userID).Order("id").Find(&export.Carts).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Preload("Items").Preload("Items.Item").Where("user_id = ?", userID).Order("id").Find(&export.Wishlists).Error; err != nil {
+		return nil, err
+	}
+	if err := database.DB.Preload("Lines").Where("user_id = ?", userID).Order("id").Find(&export.Orders).Error; err != nil {
+		return nil, err
+	}
+
+	for i := range export.Carts {
+		export.Carts[i].ComputeTotals()
+	}
+
+	return export, nil
+}
+
+func zipUserExport(export *UserExport) ([]byte, error) {
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", export.Profile},
+		{"sessions.json", export.Sessions},
+		{"carts.json", export.Carts},
+		{"wishlists.json", export.Wishlists},
+		{"orders.json", export.Orders},
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		content, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		writer, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := writer.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
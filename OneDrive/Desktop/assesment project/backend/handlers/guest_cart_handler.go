@@ -0,0 +1,273 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"shopping-cart/auth"
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// CartTokenHeader carries the signed token of a guest cart. Sending it with
+// a login or sign-up merges the guest cart into the user's cart.
+const CartTokenHeader = "X-Cart-Token"
+
+// Outcomes of merging a guest cart line into a user's cart
+const (
+	CartMergeAdded   = "added"
+	CartMergeMerged  = "merged"
+	CartMergeSkipped = "skipped"
+)
+
+// CartMergeLine reports what happened to one guest cart line. CartQuantity
+// is the quantity of the line in the user's cart after the merge.
+type CartMergeLine struct {
+	ItemID       uint   `json:"item_id"`
+	Quantity     int    `json:"quantity"`
+	Outcome      string `json:"outcome"`
+	CartQuantity int    `json:"cart_quantity,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+}
+
+// CartMergeReport describes how a guest cart was merged into a user's cart.
+type CartMergeReport struct {
+	CartID uint            `json:"cart_id"`
+	Lines  []CartMergeLine `json:"lines"`
+}
+
+// AddGuestCartItems adds items to the guest cart behind the request's cart
+// token, starting a new guest cart when there is no token. The response
+// carries a fresh token for the cart.
+func AddGuestCartItems(c *gin.Context) {
+	var req CreateCartRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var cart models.Cart
+	if token := c.GetHeader(CartTokenHeader); token != "" {
+		var err error
+		if cart, err = findGuestCart(database.DB, token); err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired cart token"})
+			return
+		}
+	}
+
+	expiresAt := time.Now().Add(config.Current.GuestCartTTL)
+
+	tx := database.DB.Begin()
+
+	if cart.ID == 0 {
+		cart = models.Cart{
+			Name:      "Guest Cart",
+			Guest:     true,
+			ExpiresAt: &expiresAt,
+			Status:    models.CartStatusActive,
+			CreatedAt: time.Now(),
+		}
+		if err := tx.Create(&cart).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
+			return
+		}
+	}
+
+	results, ok := addCartItems(c, tx, cart, req.ItemIDs)
+	if !ok {
+		tx.Rollback()
+		return
+	}
+
+	// The cart lives as long as the token issued below
+	if err := tx.Model(&models.Cart{}).Where("id = ?", cart.ID).Update("expires_at", expiresAt).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart"})
+		return
+	}
+
+	cart, _ = loadCart(cart.ID)
+
+	c.JSON(http.StatusOK, gin.H{
+		"cart_token": auth.SignCartToken(cart.ID, expiresAt, config.Current.CartTokenSecret),
+		"expires_at": expiresAt,
+		"cart":       cart,
+		"results":    results,
+	})
+}
+
+func GetGuestCart(c *gin.Context) {
+	cartID, ok := guestCartID(c)
+	if !ok {
+		return
+	}
+
+	if cartID == nil {
+		c.JSON(http.StatusOK, gin.H{"message": "No active cart", "cart": nil})
+		return
+	}
+
+	cart, err := loadCart(*cartID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"message": "Cart not found", "cart": nil})
+		return
+	}
+
+	c.JSON(http.StatusOK, cart)
+}
+
+func UpdateGuestCartItem(c *gin.Context) {
+	cartID, ok := guestCartID(c)
+	if !ok {
+		return
+	}
+
+	updateCartLine(c, cartID)
+}
+
+func RemoveGuestCartItem(c *gin.Context) {
+	cartID, ok := guestCartID(c)
+	if !ok {
+		return
+	}
+
+	removeCartLine(c, cartID)
+}
+
+// guestCartID resolves the request's cart token. It returns nil when no
+// token was sent, and writes a 401 for a token that is invalid, expired or
+// points at a cart that was already merged.
+func guestCartID(c *gin.Context) (*uint, bool) {
+	token := c.GetHeader(CartTokenHeader)
+	if token == "" {
+		return nil, true
+	}
+
+	cart, err := findGuestCart(database.DB, token)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired cart token"})
+		return nil, false
+	}
+	return &cart.ID, true
+}
+
+// findGuestCart loads the guest cart a cart token points at, with its items.
+func findGuestCart(db *gorm.DB, token string) (models.Cart, error) {
+	var cart models.Cart
+	cartID, err := auth.ParseCartToken(token, config.Current.CartTokenSecret, time.Now())
+	if err != nil {
+		return cart, err
+	}
+
+	err = db.Where("id = ? AND guest = ? AND status = ? AND expires_at > ?", cartID, true, models.CartStatusActive, time.Now()).
+		Preload("CartItems").Preload("CartItems.Item").
+		First(&cart).Error
+	return cart, err
+}
+
+// mergeRequestGuestCart merges the guest cart sent with a login or sign-up
+// into the user's cart. A stale or invalid token never fails the login; the
+// merge is skipped and nil returned.
+func mergeRequestGuestCart(c *gin.Context, user *models.User) *CartMergeReport {
+	token := c.GetHeader(CartTokenHeader)
+	if token == "" {
+		return nil
+	}
+
+	tx := database.DB.Begin()
+
+	report, err := mergeGuestCart(tx, user, token)
+	if err != nil {
+		tx.Rollback()
+		if !gorm.IsRecordNotFoundError(err) && err != auth.ErrInvalidToken && err != auth.ErrTokenExpired {
+			log.Printf("Failed to merge guest cart for user %d: %v", user.ID, err)
+		}
+		return nil
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		log.Printf("Failed to merge guest cart for user %d: %v", user.ID, err)
+		return nil
+	}
+	return report
+}
+
+// mergeGuestCart moves the lines of the guest cart behind token into the
+// user's active cart and deletes the guest cart. Quantities of items already
+// in the user's cart are summed; items that are no longer active, or are
+// priced in another currency than the user's cart, are skipped.
+func mergeGuestCart(tx *gorm.DB, user *models.User, token string) (*CartMergeReport, error) {
+	guest, err := findGuestCart(tx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	cart, err := userCart(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	// The guest cart's holds go first so they do not count against the
+	// user's cart when its holds are synced
+	if err := tx.Where("cart_id = ?", guest.ID).Delete(&models.StockHold{}).Error; err != nil {
+		return nil, err
+	}
+
+	report := &CartMergeReport{CartID: cart.ID, Lines: []CartMergeLine{}}
+	for _, guestLine := range guest.CartItems {
+		item := guestLine.Item
+		result := CartMergeLine{ItemID: guestLine.ItemID, Quantity: guestLine.Quantity}
+
+		if item.ID == 0 {
+			result.Outcome, result.Reason = CartMergeSkipped, "not_found"
+			report.Lines = append(report.Lines, result)
+			continue
+		}
+
+		line, added, err := addCartLine(tx, cartActor{UserID: user.ID}, cart.ID, item, guestLine.Quantity)
+		var mismatch currencyMismatchError
+		switch {
+		case err == errItemInactive:
+			result.Outcome, result.Reason = CartMergeSkipped, "inactive"
+		case errors.As(err, &mismatch):
+			result.Outcome, result.Reason = CartMergeSkipped, "currency_mismatch"
+		case err == errQuantityTooLarge:
+			result.Outcome, result.Reason = CartMergeSkipped, "quantity_limit"
+		case err != nil:
+			return nil, err
+		}
+		if result.Outcome == CartMergeSkipped {
+			report.Lines = append(report.Lines, result)
+			continue
+		}
+		result.Outcome = CartMergeMerged
+		if added {
+			result.Outcome = CartMergeAdded
+		}
+		result.CartQuantity = line.Quantity
+		report.Lines = append(report.Lines, result)
+	}
+
+	if err := tx.Where("cart_id = ?", guest.ID).Delete(&models.CartItem{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Where("cart_id = ?", guest.ID).Delete(&models.CartChange{}).Error; err != nil {
+		return nil, err
+	}
+	if err := tx.Delete(&guest).Error; err != nil {
+		return nil, err
+	}
+	return report, nil
+}
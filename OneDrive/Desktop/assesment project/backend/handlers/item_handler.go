@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"net/http"
+	"strings"
 	"time"
 
 	"shopping-cart/database"
@@ -11,8 +12,20 @@ import (
 )
 
 type CreateItemRequest struct {
-	Name   string `json:"name" binding:"required"`
-	Status string `json:"status"`
+	Name     string `json:"name" binding:"required"`
+	Status   string `json:"status"`
+	Price    int64  `json:"price"`
+	Currency string `json:"currency"`
+	Stock    *int   `json:"stock"`
+}
+
+// UpdateItemRequest holds the item fields to change; fields left out keep
+// their value. The currency cannot change, since carts hold one currency.
+type UpdateItemRequest struct {
+	Name   *string `json:"name"`
+	Status *string `json:"status"`
+	Price  *int64  `json:"price"`
+	Stock  *int    `json:"stock"`
 }
 
 func CreateItem(c *gin.Context) {
@@ -23,12 +36,34 @@ func CreateItem(c *gin.Context) {
 	}
 
 	if req.Status == "" {
-		req.Status = "active"
+		req.Status = models.ItemStatusActive
+	}
+
+	if req.Price < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Price cannot be negative"})
+		return
+	}
+
+	if req.Stock != nil && *req.Stock < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stock cannot be negative"})
+		return
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		req.Currency = models.DefaultCurrency
+	}
+	if !models.IsValidCurrency(req.Currency) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Currency must be a three-letter ISO 4217 code"})
+		return
 	}
 
 	item := models.Item{
 		Name:      req.Name,
 		Status:    req.Status,
+		Price:     req.Price,
+		Currency:  req.Currency,
+		Stock:     req.Stock,
 		CreatedAt: time.Now(),
 	}
 
@@ -40,6 +75,74 @@ func CreateItem(c *gin.Context) {
 	c.JSON(http.StatusCreated, item)
 }
 
+// UpdateItem changes an item. Users watching it on a wishlist are told when
+// it becomes active again or gets cheaper.
+func UpdateItem(c *gin.Context) {
+	var req UpdateItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var item models.Item
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&item).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	updates := map[string]interface{}{}
+
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+			return
+		}
+		updates["name"] = name
+	}
+
+	if req.Status != nil {
+		if *req.Status == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Status cannot be empty"})
+			return
+		}
+		updates["status"] = *req.Status
+	}
+
+	if req.Price != nil {
+		if *req.Price < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Price cannot be negative"})
+			return
+		}
+		updates["price"] = *req.Price
+	}
+
+	if req.Stock != nil {
+		if *req.Stock < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Stock cannot be negative"})
+			return
+		}
+		updates["stock"] = *req.Stock
+	}
+
+	if len(updates) > 0 {
+		if err := database.DB.Model(&models.Item{}).Where("id = ?", item.ID).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update item"})
+			return
+		}
+	}
+
+	var updated models.Item
+	if err := database.DB.Where("id = ?", item.ID).First(&updated).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch item"})
+		return
+	}
+
+	notifyWishlistWatchers(item, updated)
+
+	c.JSON(http.StatusOK, updated)
+}
+
 func ListItems(c *gin.Context) {
 	var items []models.Item
 	if err := database.DB.Find(&items).Error; err != nil {
@@ -47,6 +150,15 @@ func ListItems(c *gin.Context) {
 		return
 	}
 
+	// Report available-to-sell, net of every cart's active holds
+	itemPtrs := make([]*models.Item, len(items))
+	for i := range items {
+		itemPtrs[i] = &items[i]
+	}
+	if err := applyAvailability(database.DB, itemPtrs, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch items"})
+		return
+	}
+
 	c.JSON(http.StatusOK, items)
 }
-
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"shopping-cart/database"
+	"shopping-cart/mail"
+	"shopping-cart/models"
+
+	"github.com/jinzhu/gorm"
+)
+
+// Deliveries of a queued email tried before it is given up
+const maxEmailAttempts = 5
+
+// queueEmail stores msg to userID for SendQueuedEmails, so the request that
+// triggers it does not wait on the mail server.
+func queueEmail(db *gorm.DB, userID uint, msg mail.Message) error {
+	return db.Create(&models.QueuedEmail{
+		UserID:    userID,
+		Recipient: msg.To,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		CreatedAt: time.Now(),
+	}).Error
+}
+
+// SendQueuedEmails delivers the queued emails through Mailer, oldest first.
+// Sent emails are deleted; failed ones are tried again on the next run until
+// they reach maxEmailAttempts.
+func SendQueuedEmails() {
+	var emails []models.QueuedEmail
+	if err := database.DB.Where("attempts < ?", maxEmailAttempts).Order("id").Find(&emails).Error; err != nil {
+		log.Println("Failed to load queued emails:", err)
+		return
+	}
+
+	for _, email := range emails {
+		err := Mailer.Send(mail.Message{To: email.Recipient, Subject: email.Subject, Body: email.Body})
+		if err == nil {
+			database.DB.Delete(&email)
+			continue
+		}
+
+		log.Printf("Failed to send queued email %d: %v", email.ID, err)
+		database.DB.Model(&models.QueuedEmail{}).Where("id = ?", email.ID).Updates(map[string]interface{}{
+			"attempts":   gorm.Expr("attempts + 1"),
+			"last_error": err.Error(),
+		})
+	}
+}
@@ -8,10 +8,20 @@ import (
 	"shopping-cart/models"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
 )
 
+// CreateOrderRequest checks out a cart. CartVersion is the version of the
+// cart the client last read; it is required when the cart has issues, and
+// checked whenever it is sent.
 type CreateOrderRequest struct {
-	CartID uint `json:"cart_id" binding:"required"`
+	CartID      uint   `json:"cart_id" binding:"required"`
+	CartVersion string `json:"cart_version"`
+}
+
+type TransitionOrderRequest struct {
+	Status string `json:"status" binding:"required"`
+	Note   string `json:"note"`
 }
 
 func CreateOrder(c *gin.Context) {
@@ -32,13 +42,87 @@ func CreateOrder(c *gin.Context) {
 	// Verify cart belongs to user
 	var cart models.Cart
 	if err := database.DB.Where("id = ? AND user_id = ?", req.CartID, currentUser.ID).First(&cart).Error; err != nil {
+		// Collaborators can fill a cart but only its owner checks it out
+		var collaborators int
+		database.DB.Model(&models.CartCollaborator{}).Where("cart_id = ? AND user_id = ?", req.CartID, currentUser.ID).Count(&collaborators)
+		if collaborators > 0 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the cart owner can check out"})
+			return
+		}
 		c.JSON(http.StatusNotFound, gin.H{"error": "Cart not found or does not belong to user"})
 		return
 	}
 
-	// Check if cart is already checked out
-	if cart.Status == "checked_out" || cart.Status == "completed" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Cart already checked out"})
+	tx := database.DB.Begin()
+
+	// Claim the cart: only one concurrent checkout can move it out of an open status
+	result := tx.Model(&models.Cart{}).
+		Where("id = ? AND status NOT IN (?)", cart.ID, []string{models.CartStatusCheckedOut, models.CartStatusCompleted}).
+		Update("status", models.CartStatusCheckedOut)
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check out cart"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart already checked out"})
+		return
+	}
+
+	// Lines are loaded in item order so concurrent checkouts lock items in the same order
+	if err := tx.Where("id = ?", cart.ID).Preload("CartItems", func(db *gorm.DB) *gorm.DB {
+		return db.Order("item_id")
+	}).Preload("CartItems.Item").First(&cart).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load cart"})
+		return
+	}
+
+	// Items may have been deactivated or repriced since they were added; the
+	// client must have seen the cart as it is now before it is ordered
+	cart.Revalidate()
+	if (len(cart.Issues) > 0 || req.CartVersion != "") && req.CartVersion != cart.Version {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{
+			"error":        "Cart has changed, review it and confirm with its version",
+			"issues":       cart.Issues,
+			"cart_version": cart.Version,
+		})
+		return
+	}
+
+	// Acknowledged lines whose item is gone or inactive are left out
+	orderable := cart.CartItems[:0]
+	for _, cartItem := range cart.CartItems {
+		if cartItem.Item.ID != 0 && cartItem.Item.IsActive() {
+			orderable = append(orderable, cartItem)
+		}
+	}
+	if len(orderable) == 0 && len(cart.CartItems) > 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "No item in the cart can be ordered"})
+		return
+	}
+	cart.CartItems = orderable
+
+	cart.ComputeTotals()
+	if cart.Total == nil {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Cart contains items priced in more than one currency"})
+		return
+	}
+
+	// Take the ordered quantities out of stock
+	shortages, err := reserveStock(tx, cart.ID, cart.CartItems)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reserve stock"})
+		return
+	}
+	if len(shortages) > 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Insufficient stock", "shortages": shortages})
 		return
 	}
 
@@ -46,36 +130,136 @@ func CreateOrder(c *gin.Context) {
 	order := models.Order{
 		CartID:    req.CartID,
 		UserID:    currentUser.ID,
+		Status:    models.OrderStatusPending,
+		Total:     *cart.Total,
 		CreatedAt: time.Now(),
 	}
 
-	if err := database.DB.Create(&order).Error; err != nil {
+	if err := tx.Create(&order).Error; err != nil {
+		tx.Rollback()
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
 		return
 	}
 
-	// Mark cart as checked out
-	cart.Status = "checked_out"
-	database.DB.Save(&cart)
+	// Start the order's status history
+	if err := tx.Create(&models.OrderTransition{
+		OrderID:   order.ID,
+		ToStatus:  order.Status,
+		ActorID:   currentUser.ID,
+		CreatedAt: order.CreatedAt,
+	}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record order transition"})
+		return
+	}
 
-	// Clear user's cart_id
-	currentUser.CartID = nil
-	database.DB.Save(currentUser)
+	// Snapshot cart lines so later item changes do not alter the order
+	for _, line := range models.OrderLinesFromCart(cart) {
+		line.OrderID = order.ID
+		line.CreatedAt = order.CreatedAt
+		if err := tx.Create(&line).Error; err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order lines"})
+			return
+		}
+	}
+
+	// Clear user's cart_id if it still points at this cart
+	if err := tx.Model(&models.User{}).Where("id = ? AND cart_id = ?", currentUser.ID, cart.ID).Update("cart_id", gorm.Expr("NULL")).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear user cart"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+		return
+	}
 
 	// Reload order with relationships
-	database.DB.Where("id = ?", order.ID).Preload("Cart").Preload("User").First(&order)
+	database.DB.Where("id = ?", order.ID).Preload("Lines").Preload("User").First(&order)
 
 	c.JSON(http.StatusCreated, order)
 }
 
+// reserveStock decrements the stock of every tracked item in cartItems,
+// leaving untouched whatever other carts are holding. It reports each line
+// that cannot be covered; the caller must roll back the transaction in that
+// case.
+func reserveStock(tx *gorm.DB, cartID uint, cartItems []models.CartItem) ([]models.StockShortage, error) {
+	var shortages []models.StockShortage
+	for _, cartItem := range cartItems {
+		if !cartItem.Item.TracksStock() {
+			continue
+		}
+
+		result := tx.Exec(`UPDATE items SET stock = stock - ? WHERE id = ? AND stock - (
+				SELECT COALESCE(SUM(quantity), 0) FROM stock_holds
+				WHERE item_id = ? AND cart_id <> ? AND expires_at > ?
+			) >= ?`,
+			cartItem.Quantity, cartItem.ItemID, cartItem.ItemID, cartID, time.Now(), cartItem.Quantity)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			continue
+		}
+
+		var item models.Item
+		if err := tx.First(&item, cartItem.ItemID).Error; err != nil {
+			return nil, err
+		}
+		if err := applyAvailability(tx, []*models.Item{&item}, cartID); err != nil {
+			return nil, err
+		}
+		if shortage, short := models.NewStockShortage(item, cartItem.Quantity); short {
+			shortages = append(shortages, shortage)
+		}
+	}
+
+	// The cart's own holds have been turned into real decrements
+	if err := tx.Where("cart_id = ?", cartID).Delete(&models.StockHold{}).Error; err != nil {
+		return nil, err
+	}
+	return shortages, nil
+}
+
+// restoreStock gives back the quantities of the order's lines to the items
+// that track stock. Run it in the transaction that moves the order, so a
+// concurrent transition cannot restock it twice.
+func restoreStock(tx *gorm.DB, orderID uint) error {
+	var lines []models.OrderLine
+	if err := tx.Where("order_id = ?", orderID).Find(&lines).Error; err != nil {
+		return err
+	}
+	for _, line := range lines {
+		if err := tx.Exec("UPDATE items SET stock = stock + ? WHERE id = ? AND stock IS NOT NULL", line.Quantity, line.ItemID).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func ListOrders(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
 	var orders []models.Order
-	query := database.DB.Preload("Cart").Preload("Cart.CartItems").Preload("Cart.CartItems.Item").Preload("User")
+	query := database.DB.Preload("Lines").Preload("User")
 
-	// Optional filtering by user_id
-	userID := c.Query("user_id")
-	if userID != "" {
-		query = query.Where("user_id = ?", userID)
+	// Staff may see every order, optionally filtered by user_id; everyone
+	// else only sees their own
+	if currentUser.Can(models.PermOrdersReadAll) {
+		if userID := c.Query("user_id"); userID != "" {
+			query = query.Where("user_id = ?", userID)
+		}
+	} else {
+		query = query.Where("user_id = ?", currentUser.ID)
 	}
 
 	if err := query.Find(&orders).Error; err != nil {
@@ -86,3 +270,118 @@ func ListOrders(c *gin.Context) {
 	c.JSON(http.StatusOK, orders)
 }
 
+func TransitionOrder(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
+	var req TransitionOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !models.IsValidOrderStatus(req.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status: " + req.Status})
+		return
+	}
+
+	var order models.Order
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&order).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	if !order.CanTransitionTo(req.Status) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error":   "Cannot transition order from " + order.Status + " to " + req.Status,
+			"status":  order.Status,
+			"allowed": order.AllowedTransitions(),
+		})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	// Only move the order if nobody else changed its status in the meantime
+	result := tx.Model(&models.Order{}).Where("id = ? AND status = ?", order.ID, order.Status).Update("status", req.Status)
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusConflict, gin.H{"error": "Order status changed concurrently, please retry"})
+		return
+	}
+
+	if models.ReleasesStock(req.Status) {
+		if err := restoreStock(tx, order.ID); err != nil {
+			tx.Rollback()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to restore stock"})
+			return
+		}
+	}
+
+	transition := models.OrderTransition{
+		OrderID:    order.ID,
+		FromStatus: order.Status,
+		ToStatus:   req.Status,
+		Note:       req.Note,
+		ActorID:    currentUser.ID,
+		CreatedAt:  time.Now(),
+	}
+	if err := tx.Create(&transition).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record order transition"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update order status"})
+		return
+	}
+
+	database.DB.Where("id = ?", order.ID).Preload("Lines").Preload("User").First(&order)
+
+	c.JSON(http.StatusOK, order)
+}
+
+func GetOrderHistory(c *gin.Context) {
+	user, exists := c.Get("user")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+		return
+	}
+
+	currentUser := user.(*models.User)
+
+	var order models.Order
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&order).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	// Customers can only see the history of their own orders
+	if order.UserID != currentUser.ID && !currentUser.Can(models.PermOrdersReadAll) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+		return
+	}
+
+	var transitions []models.OrderTransition
+	if err := database.DB.Where("order_id = ?", order.ID).Order("created_at, id").Find(&transitions).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch order history"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"order_id": order.ID,
+		"status":   order.Status,
+		"history":  transitions,
+	})
+}
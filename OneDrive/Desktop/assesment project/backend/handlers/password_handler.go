@@ -0,0 +1,238 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"shopping-cart/auth"
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/mail"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Mailer delivers outgoing email. main replaces it according to the config.
+var Mailer mail.Mailer = &mail.OutboxMailer{Dir: "outbox"}
+
+type ForgotPasswordRequest struct {
+	Username string `json:"username"`
+	Email    string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required"`
+}
+
+// ForgotPassword mails a reset link to the account's email address and ends
+// every session of the account. The response is the same whether or not the
+// account exists, so it cannot be used to discover usernames. While a token
+// issued less than PasswordResetCooldown ago is unused, nothing is done, so
+// the endpoint cannot be used to keep logging someone out.
+func ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.Username == "" && req.Email == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Username or email is required"})
+		return
+	}
+
+	accepted := gin.H{"message": "If the account exists, a password reset link has been sent"}
+
+	var user models.User
+	query := database.DB
+	if req.Username != "" {
+		query = query.Where("username = ?", req.Username)
+	} else {
+		query = query.Where("email = ?", req.Email)
+	}
+	if err := query.First(&user).Error; err != nil || user.Email == nil {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+
+	now := time.Now()
+	var recent int
+	if err := database.DB.Model(&models.PasswordResetToken{}).
+		Where("user_id = ? AND used_at IS NULL AND created_at > ?", user.ID, now.Add(-config.Current.PasswordResetCooldown)).
+		Count(&recent).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	if recent > 0 {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	resetToken := models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: models.HashSessionToken(token),
+		ExpiresAt: now.Add(config.Current.PasswordResetTTL),
+		CreatedAt: now,
+	}
+
+	tx := database.DB.Begin()
+
+	// Only the newest reset link works
+	if err := tx.Where("user_id = ? AND used_at IS NULL", user.ID).Delete(&models.PasswordResetToken{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	if err := tx.Create(&resetToken).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+	if err := revokeAllSessions(tx, user.ID); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create reset token"})
+		return
+	}
+
+	link := config.Current.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	msg := mail.Message{
+		To:      *user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hello %s,\n\nUse the link below to choose a new password. It expires in %s and can only be used once.\n\n%s\n\nReset token: %s\n\nIf you did not ask for this, you can ignore this email.\n",
+			user.Username, config.Current.PasswordResetTTL, link, token),
+	}
+	if err := Mailer.Send(msg); err != nil {
+		log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+	}
+
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// ResetPassword consumes a reset token, sets the new password and ends every
+// session of the account.
+func ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var resetToken models.PasswordResetToken
+	if err := database.DB.Where("token_hash = ?", models.HashSessionToken(req.Token)).First(&resetToken).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ?", resetToken.UserID).First(&user).Error; err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if !checkPasswordPolicy(c, "new_password", user.Username, req.NewPassword) {
+		return
+	}
+
+	hashedPassword, err := passwordHasher().Hash(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	now := time.Now()
+	tx := database.DB.Begin()
+
+	// Claim the token; a concurrent or repeated reset finds it already used
+	result := tx.Model(&models.PasswordResetToken{}).
+		Where("id = ? AND used_at IS NULL AND expires_at > ?", resetToken.ID, now).
+		Update("used_at", now)
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired reset token"})
+		return
+	}
+
+	if err := tx.Model(&models.User{}).Where("id = ?", resetToken.UserID).Update("password", hashedPassword).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+	if err := revokeAllSessions(tx, resetToken.UserID); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password has been reset"})
+}
+
+// passwordHasher returns the hasher for new passwords, as configured.
+func passwordHasher() auth.PasswordHasher {
+	return auth.PasswordHasher{Algorithm: config.Current.PasswordHasher, BcryptCost: config.Current.BcryptCost}
+}
+
+// checkPasswordPolicy answers with 400 and the problems under field when
+// password breaks the policy.
+func checkPasswordPolicy(c *gin.Context, field, username, password string) bool {
+	policy := auth.PasswordPolicy{MinLength: config.Current.PasswordMinLength}
+	if problems := policy.Check(username, password); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error":  "Password does not meet the requirements",
+			"fields": gin.H{field: problems},
+		})
+		return false
+	}
+	return true
+}
+
+// upgradePasswordHash rehashes a just-verified password when the stored hash
+// uses an outdated algorithm or cost. Failures only mean the upgrade is
+// retried at the next login.
+func upgradePasswordHash(user *models.User, password string) {
+	hasher := passwordHasher()
+	if !hasher.NeedsRehash(user.Password) {
+		return
+	}
+
+	hashedPassword, err := hasher.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash password of user %d: %v", user.ID, err)
+		return
+	}
+
+	// Skip the upgrade if the password changed since it was verified
+	result := database.DB.Model(&models.User{}).
+		Where("id = ? AND password = ?", user.ID, user.Password).
+		Update("password", hashedPassword)
+	if result.Error != nil {
+		log.Printf("Failed to store rehashed password of user %d: %v", user.ID, result.Error)
+		return
+	}
+	if result.RowsAffected == 1 {
+		user.Password = hashedPassword
+	}
+}
@@ -0,0 +1,285 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// UpdateProfileRequest holds the profile fields to change; fields left out
+// keep their value. An empty email removes the address.
+type UpdateProfileRequest struct {
+	Username    *string `json:"username"`
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required"`
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password" binding:"required"`
+}
+
+func GetProfile(c *gin.Context) {
+	user, _ := c.Get("user")
+	c.JSON(http.StatusOK, user.(*models.User))
+}
+
+func UpdateProfile(c *gin.Context) {
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	updates := map[string]interface{}{}
+
+	if req.Username != nil {
+		username := strings.TrimSpace(*req.Username)
+		if username == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Username cannot be empty"})
+			return
+		}
+		var count int
+		database.DB.Model(&models.User{}).Where("username = ? AND id <> ?", username, currentUser.ID).Count(&count)
+		if count > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Username already exists"})
+			return
+		}
+		updates["username"] = username
+	}
+
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if len(displayName) > 100 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Display name must be at most 100 characters"})
+			return
+		}
+		updates["display_name"] = displayName
+	}
+
+	if req.Email != nil {
+		email, ok := checkEmail(c, strings.TrimSpace(*req.Email), currentUser.ID)
+		if !ok {
+			return
+		}
+		if email == nil {
+			updates["email"] = gorm.Expr("NULL")
+		} else {
+			updates["email"] = *email
+		}
+	}
+
+	if len(updates) > 0 {
+		if err := database.DB.Model(&models.User{}).Where("id = ?", currentUser.ID).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+	}
+
+	var updated models.User
+	if err := database.DB.Where("id = ?", currentUser.ID).First(&updated).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch profile"})
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
+
+// ChangePassword sets a new password after checking the current one. Every
+// other session of the user is ended; the one making the request stays.
+func ChangePassword(c *gin.Context) {
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	if !checkCurrentPassword(c, currentUser, req.CurrentPassword) {
+		return
+	}
+
+	if !checkPasswordPolicy(c, "new_password", currentUser.Username, req.NewPassword) {
+		return
+	}
+
+	hashedPassword, err := passwordHasher().Hash(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Model(&models.User{}).Where("id = ?", currentUser.ID).Update("password", hashedPassword).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+	if err := revokeOtherSessions(tx, currentUser.ID, c.GetUint("session_id")); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed"})
+}
+
+// DeleteAccount deletes the current user after checking their password.
+// Orders are kept for accounting but no longer point at the user, and the
+// carts they came from are detached the same way; everything else the user
+// owned is deleted.
+func DeleteAccount(c *gin.Context) {
+	var req DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	if !checkCurrentPassword(c, currentUser, req.Password) {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := deleteUserData(tx, currentUser.ID); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete account"})
+		return
+	}
+
+	if err := LoginGuard.Unlock(currentUser.Username); err != nil {
+		log.Printf("Failed to clear login attempts for %q: %v", currentUser.Username, err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// deleteUserData removes a user and their personal records, anonymizing the
+// orders and the carts that orders were placed from.
+func deleteUserData(tx *gorm.DB, userID uint) error {
+	orderedCarts := tx.Model(&models.Order{}).Select("cart_id").Where("user_id = ?", userID).QueryExpr()
+	openCarts := tx.Model(&models.Cart{}).Select("id").Where("user_id = ? AND id NOT IN (?)", userID, orderedCarts).QueryExpr()
+
+	userCarts := tx.Model(&models.Cart{}).Select("id").Where("user_id = ?", userID).QueryExpr()
+
+	steps := []func() error{
+		func() error {
+			return tx.Where("cart_id IN (?)", userCarts).Delete(&models.CartShare{}).Error
+		},
+		func() error {
+			return tx.Where("cart_id IN (?) OR user_id = ?", userCarts, userID).Delete(&models.CartCollaborator{}).Error
+		},
+		func() error {
+			return tx.Where("cart_id IN (?)", openCarts).Delete(&models.CartChange{}).Error
+		},
+		func() error {
+			return tx.Model(&models.CartChange{}).Where("actor_id = ?", userID).Update("actor_id", models.DeletedUserID).Error
+		},
+		func() error {
+			return tx.Where("cart_id IN (?)", openCarts).Delete(&models.StockHold{}).Error
+		},
+		func() error {
+			return tx.Where("cart_id IN (?)", openCarts).Delete(&models.CartItem{}).Error
+		},
+		func() error {
+			return tx.Where("id IN (?)", openCarts).Delete(&models.Cart{}).Error
+		},
+		func() error {
+			return tx.Model(&models.Cart{}).Where("user_id = ?", userID).Update("user_id", models.DeletedUserID).Error
+		},
+		func() error {
+			return tx.Model(&models.Order{}).Where("user_id = ?", userID).Update("user_id", models.DeletedUserID).Error
+		},
+		func() error {
+			return tx.Model(&models.OrderTransition{}).Where("actor_id = ?", userID).Update("actor_id", models.DeletedUserID).Error
+		},
+		func() error { return revokeAllSessions(tx, userID) },
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.IdempotencyKey{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.PasswordResetToken{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.LoginChallenge{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.APIKey{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.QueuedEmail{}).Error
+		},
+		func() error {
+			return tx.Where("wishlist_id IN (?)", tx.Model(&models.Wishlist{}).Select("id").Where("user_id = ?", userID).QueryExpr()).Delete(&models.WishlistItem{}).Error
+		},
+		func() error {
+			return tx.Where("user_id = ?", userID).Delete(&models.Wishlist{}).Error
+		},
+		func() error {
+			return tx.Where("id = ?", userID).Delete(&models.User{}).Error
+		},
+	}
+
+	for _, step := range steps {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCurrentPassword re-authenticates the user for a sensitive change.
+// Wrong passwords count as failed logins.
+func checkCurrentPassword(c *gin.Context, user *models.User, password string) bool {
+	wait, locked, err := LoginGuard.Check(user.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return false
+	}
+	if wait > 0 {
+		tooManyLoginAttempts(c, wait, locked)
+		return false
+	}
+
+	match, err := passwordHasher().Verify(user.Password, password)
+	if err != nil {
+		log.Printf("Failed to verify password of user %d: %v", user.ID, err)
+	}
+	if !match {
+		loginFailed(c, user.Username, "Current password is incorrect")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"time"
+
+	"shopping-cart/config"
+	"shopping-cart/models"
+
+	"github.com/jinzhu/gorm"
+)
+
+// heldQuantities returns the units held by active holds per item, ignoring
+// holds that belong to excludeCartID (pass 0 to count every cart).
+func heldQuantities(db *gorm.DB, itemIDs []uint, excludeCartID uint) (map[uint]int, error) {
+	var rows []struct {
+		ItemID   uint
+		Quantity int
+	}
+	query := db.Model(&models.StockHold{}).
+		Select("item_id, SUM(quantity) AS quantity").
+		Where("item_id IN (?) AND cart_id <> ? AND expires_at > ?", itemIDs, excludeCartID, time.Now()).
+		Group("item_id")
+	if err := query.Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	held := make(map[uint]int, len(rows))
+	for _, row := range rows {
+		held[row.ItemID] = row.Quantity
+	}
+	return held, nil
+}
+
+// applyAvailability sets Available on every stock-tracked item to its stock
+// minus what other carts are holding.
+func applyAvailability(db *gorm.DB, items []*models.Item, excludeCartID uint) error {
+	itemIDs := make([]uint, 0, len(items))
+	for _, item := range items {
+		if item.TracksStock() {
+			itemIDs = append(itemIDs, item.ID)
+		}
+	}
+	if len(itemIDs) == 0 {
+		return nil
+	}
+
+	held, err := heldQuantities(db, itemIDs, excludeCartID)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		if !item.TracksStock() {
+			continue
+		}
+		available := *item.Stock - held[item.ID]
+		if available < 0 {
+			available = 0
+		}
+		item.Available = &available
+	}
+	return nil
+}
+
+// syncStockHold makes the cart's hold on item match quantity, capped at what
+// other carts leave available, and restarts its expiry. It does nothing
+// unless stock holds are enabled, and never holds stock for guest carts.
+func syncStockHold(db *gorm.DB, cartID uint, item models.Item, quantity int) error {
+	if !config.Current.StockHoldsEnabled || !item.TracksStock() {
+		return nil
+	}
+
+	// Anyone can start a guest cart, so guest carts never hold stock
+	var guests int
+	if err := db.Model(&models.Cart{}).Where("id = ? AND guest = ?", cartID, true).Count(&guests).Error; err != nil {
+		return err
+	}
+	if guests > 0 {
+		return nil
+	}
+
+	if err := applyAvailability(db, []*models.Item{&item}, cartID); err != nil {
+		return err
+	}
+	if quantity > item.AvailableStock() {
+		quantity = item.AvailableStock()
+	}
+	if quantity <= 0 {
+		return releaseStockHold(db, cartID, item.ID)
+	}
+
+	now := time.Now()
+	var hold models.StockHold
+	if err := db.Where("cart_id = ? AND item_id = ?", cartID, item.ID).First(&hold).Error; err != nil {
+		hold = models.StockHold{
+			CartID:    cartID,
+			ItemID:    item.ID,
+			Quantity:  quantity,
+			ExpiresAt: now.Add(config.Current.StockHoldTTL),
+			CreatedAt: now,
+		}
+		return db.Create(&hold).Error
+	}
+
+	return db.Model(&hold).Updates(map[string]interface{}{
+		"quantity":   quantity,
+		"expires_at": now.Add(config.Current.StockHoldTTL),
+	}).Error
+}
+
+func releaseStockHold(db *gorm.DB, cartID, itemID uint) error {
+	return db.Where("cart_id = ? AND item_id = ?", cartID, itemID).Delete(&models.StockHold{}).Error
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"shopping-cart/auth"
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// startSession creates a session for an authenticated user and writes the
+// login response. In opaque mode the session token is the bearer token; in
+// JWT mode it becomes the refresh token and a signed access token is issued
+// alongside it. A guest cart token sent with the request is merged into the
+// user's cart and reported as cart_merge.
+func startSession(c *gin.Context, user *models.User) {
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	// Start a new session; sessions on other devices stay valid
+	now := time.Now()
+	session := models.Session{
+		UserID:     user.ID,
+		TokenHash:  models.HashSessionToken(token),
+		UserAgent:  c.Request.UserAgent(),
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(config.Current.SessionTTL),
+	}
+	if err := database.DB.Create(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create session"})
+		return
+	}
+
+	response := gin.H{
+		"user": gin.H{
+			"id":       user.ID,
+			"username": user.Username,
+			"role":     user.Role,
+		},
+	}
+	if cartMerge := mergeRequestGuestCart(c, user); cartMerge != nil {
+		response["cart_merge"] = cartMerge
+	}
+
+	if config.Current.AuthMode != config.AuthModeJWT {
+		response["token"] = token
+		response["expires_at"] = session.ExpiresAt
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	accessToken, claims, err := issueAccessToken(user, session.ID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign access token"})
+		return
+	}
+
+	response["token"] = accessToken
+	response["token_type"] = "Bearer"
+	response["expires_at"] = time.Unix(claims.ExpiresAt, 0).UTC()
+	response["refresh_token"] = token
+	response["refresh_expires_at"] = session.ExpiresAt
+	c.JSON(http.StatusOK, response)
+}
+
+func issueAccessToken(user *models.User, sessionID uint, now time.Time) (string, auth.Claims, error) {
+	claims := auth.Claims{
+		Issuer:    config.Current.JWTIssuer,
+		Subject:   user.ID,
+		Username:  user.Username,
+		Role:      user.Role,
+		SessionID: sessionID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(config.Current.AccessTokenTTL).Unix(),
+	}
+	token, err := auth.SignHS256(claims, config.Current.JWTSecret)
+	return token, claims, err
+}
+
+// RefreshToken exchanges a refresh token for a new access token and a new
+// refresh token. The old refresh token is remembered; if it is ever
+// presented again the session is revoked, since only a stolen copy could
+// still be in use.
+func RefreshToken(c *gin.Context) {
+	if config.Current.AuthMode != config.AuthModeJWT {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Refresh tokens are only used in JWT mode"})
+		return
+	}
+
+	var req RefreshTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tokenHash := models.HashSessionToken(req.RefreshToken)
+	now := time.Now()
+
+	var session models.Session
+	if err := database.DB.Where("token_hash = ?", tokenHash).Preload("User").First(&session).Error; err != nil {
+		var used models.UsedRefreshToken
+		if err := database.DB.Where("token_hash = ?", tokenHash).First(&used).Error; err == nil {
+			revokeSession(used.SessionID)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected, session revoked"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if session.IsExpired(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token has expired"})
+		return
+	}
+
+	newToken, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	// Swap the token only if no concurrent refresh rotated it first
+	result := tx.Model(&models.Session{}).Where("id = ? AND token_hash = ?", session.ID, tokenHash).
+		Updates(map[string]interface{}{"token_hash": models.HashSessionToken(newToken), "last_used_at": now})
+	if result.Error != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate refresh token"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+
+	if err := tx.Create(&models.UsedRefreshToken{SessionID: session.ID, TokenHash: tokenHash, UsedAt: now}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate refresh token"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate refresh token"})
+		return
+	}
+
+	accessToken, claims, err := issueAccessToken(&session.User, session.ID, now)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign access token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token":              accessToken,
+		"token_type":         "Bearer",
+		"expires_at":         time.Unix(claims.ExpiresAt, 0).UTC(),
+		"refresh_token":      newToken,
+		"refresh_expires_at": session.ExpiresAt,
+	})
+}
+
+// revokeSession deletes a session together with its rotated refresh tokens.
+func revokeSession(sessionID uint) error {
+	if err := database.DB.Where("session_id = ?", sessionID).Delete(&models.UsedRefreshToken{}).Error; err != nil {
+		return err
+	}
+	return database.DB.Where("id = ?", sessionID).Delete(&models.Session{}).Error
+}
+
+// revokeAllSessions deletes every session of a user, with their rotated
+// refresh tokens.
+func revokeAllSessions(db *gorm.DB, userID uint) error {
+	return revokeOtherSessions(db, userID, 0)
+}
+
+// revokeOtherSessions deletes every session of a user except keepSessionID,
+// with their rotated refresh tokens.
+func revokeOtherSessions(db *gorm.DB, userID, keepSessionID uint) error {
+	sessions := db.Model(&models.Session{}).Where("user_id = ? AND id <> ?", userID, keepSessionID)
+	if err := db.Where("session_id IN (?)", sessions.Select("id").QueryExpr()).Delete(&models.UsedRefreshToken{}).Error; err != nil {
+		return err
+	}
+	return db.Where("user_id = ? AND id <> ?", userID, keepSessionID).Delete(&models.Session{}).Error
+}
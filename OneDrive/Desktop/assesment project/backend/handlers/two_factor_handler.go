@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"shopping-cart/auth"
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+// totpNow is the clock for two-factor checks.
+var totpNow = time.Now
+
+// SetTOTPClock replaces the clock for two-factor checks, so tests can move
+// through TOTP steps. Pass time.Now to restore it.
+func SetTOTPClock(now func() time.Time) {
+	totpNow = now
+}
+
+const (
+	recoveryCodeCount = 10
+	// Wrong codes allowed per login challenge before it is discarded
+	maxChallengeAttempts = 5
+)
+
+type TwoFactorCodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type TwoFactorLoginRequest struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	Code           string `json:"code" binding:"required"`
+}
+
+// EnrollTwoFactor generates a new TOTP secret for the current user. It only
+// takes effect once VerifyTwoFactor confirms a first code.
+func EnrollTwoFactor(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	if currentUser.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := auth.GenerateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	if err := database.DB.Model(currentUser).Updates(map[string]interface{}{"totp_secret": secret, "totp_last_step": 0}).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start enrolment"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      secret,
+		"otpauth_uri": auth.TOTPURI(config.Current.TwoFactorIssuer, currentUser.Username, secret),
+	})
+}
+
+// VerifyTwoFactor confirms enrolment with a first code, turns two-factor
+// authentication on and returns the recovery codes. They are shown only
+// once.
+func VerifyTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	if currentUser.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is already enabled"})
+		return
+	}
+	if currentUser.TOTPSecret == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Start enrolment first"})
+		return
+	}
+
+	step, ok := auth.ValidateTOTP(currentUser.TOTPSecret, req.Code, totpNow(), currentUser.TOTPLastStep)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Model(currentUser).Updates(map[string]interface{}{"two_factor_enabled": true, "totp_last_step": step}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, currentUser.ID)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create recovery codes"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to enable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"two_factor_enabled": true,
+		"recovery_codes":     codes,
+	})
+}
+
+// DisableTwoFactor turns two-factor authentication off after checking a
+// current TOTP or recovery code.
+func DisableTwoFactor(c *gin.Context) {
+	var req TwoFactorCodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	if !currentUser.TwoFactorEnabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "Two-factor authentication is not enabled"})
+		return
+	}
+
+	ok, err := consumeSecondFactor(currentUser, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid code"})
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Model(currentUser).Updates(map[string]interface{}{"two_factor_enabled": false, "totp_secret": "", "totp_last_step": 0}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+	if err := tx.Where("user_id = ?", currentUser.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to disable two-factor authentication"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"two_factor_enabled": false})
+}
+
+// LoginTwoFactor is the second login step: it exchanges the challenge token
+// from Login and a TOTP or recovery code for a session.
+func LoginTwoFactor(c *gin.Context) {
+	var req TwoFactorLoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var challenge models.LoginChallenge
+	if err := database.DB.Where("token_hash = ? AND expires_at > ?", models.HashSessionToken(req.ChallengeToken), totpNow()).First(&challenge).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ?", challenge.UserID).First(&user).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	// Wrong codes count as failed logins, so the backoff and lockout also
+	// cover guessing the second factor
+	wait, locked, err := LoginGuard.Check(user.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		tooManyLoginAttempts(c, wait, locked)
+		return
+	}
+
+	ok, err := consumeSecondFactor(&user, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check code"})
+		return
+	}
+	if !ok {
+		if challenge.Attempts+1 >= maxChallengeAttempts {
+			database.DB.Delete(&challenge)
+		} else {
+			database.DB.Model(&models.LoginChallenge{}).Where("id = ?", challenge.ID).Update("attempts", gorm.Expr("attempts + 1"))
+		}
+
+		loginFailed(c, user.Username, "Invalid code")
+		return
+	}
+
+	// The challenge is single-use; losing a race for it means another
+	// request already started the session
+	if result := database.DB.Delete(&challenge); result.Error != nil || result.RowsAffected == 0 {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired challenge"})
+		return
+	}
+
+	if err := LoginGuard.Succeed(user.Username); err != nil {
+		log.Printf("Failed to reset login attempts for %q: %v", user.Username, err)
+	}
+
+	startSession(c, &user)
+}
+
+// startTwoFactorChallenge answers a correct password for an account with
+// two-factor authentication with a challenge token instead of a session.
+func startTwoFactorChallenge(c *gin.Context, user *models.User) {
+	token, err := generateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	now := totpNow()
+	challenge := models.LoginChallenge{
+		UserID:    user.ID,
+		TokenHash: models.HashSessionToken(token),
+		ExpiresAt: now.Add(config.Current.TwoFactorChallengeTTL),
+		CreatedAt: now,
+	}
+	if err := database.DB.Create(&challenge).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create login challenge"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"two_factor_required": true,
+		"challenge_token":     token,
+		"expires_at":          challenge.ExpiresAt,
+	})
+}
+
+// consumeSecondFactor accepts a TOTP code that was not used before, or an
+// unused recovery code, and marks it as used.
+func consumeSecondFactor(user *models.User, code string) (bool, error) {
+	if step, ok := auth.ValidateTOTP(user.TOTPSecret, code, totpNow(), user.TOTPLastStep); ok {
+		result := database.DB.Model(&models.User{}).
+			Where("id = ? AND totp_last_step < ?", user.ID, step).
+			Update("totp_last_step", step)
+		if result.Error != nil {
+			return false, result.Error
+		}
+		return result.RowsAffected == 1, nil
+	}
+
+	hash := models.HashSessionToken(auth.NormalizeRecoveryCode(code))
+	result := database.DB.Model(&models.RecoveryCode{}).
+		Where("user_id = ? AND code_hash = ? AND used_at IS NULL", user.ID, hash).
+		Update("used_at", totpNow())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and creates a new
+// set, returning the codes in plain text.
+func replaceRecoveryCodes(tx *gorm.DB, userID uint) ([]string, error) {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := auth.GenerateRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		recoveryCode := models.RecoveryCode{
+			UserID:    userID,
+			CodeHash:  models.HashSessionToken(auth.NormalizeRecoveryCode(code)),
+			CreatedAt: totpNow(),
+		}
+		if err := tx.Create(&recoveryCode).Error; err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
@@ -3,19 +3,55 @@ package handlers
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"log"
+	"math"
 	"net/http"
+	netmail "net/mail"
+	"strconv"
 	"time"
 
+	"shopping-cart/auth"
+	"shopping-cart/config"
 	"shopping-cart/database"
 	"shopping-cart/models"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type CreateUserRequest struct {
 	Username string `json:"username" binding:"required"`
 	Password string `json:"password" binding:"required"`
+	Email    string `json:"email"`
+}
+
+// LoginGuard throttles failed logins. main replaces it once the config is
+// loaded.
+var LoginGuard = NewLoginGuard(config.Current)
+
+// NewLoginGuard builds an in-process login guard from the login settings.
+func NewLoginGuard(cfg config.Config) *auth.LoginGuard {
+	return &auth.LoginGuard{
+		Store: auth.NewMemoryAttemptStore(),
+		Account: auth.AttemptPolicy{
+			FreeAttempts:  cfg.LoginFreeAttempts,
+			BackoffBase:   cfg.LoginBackoffBase,
+			BackoffMax:    cfg.LoginBackoffMax,
+			LockThreshold: cfg.LoginLockoutThreshold,
+			LockDuration:  cfg.LoginLockoutDuration,
+			Window:        cfg.LoginLockoutDuration,
+		},
+		IP: auth.AttemptPolicy{
+			FreeAttempts: cfg.LoginIPFreeAttempts,
+			BackoffBase:  cfg.LoginBackoffBase,
+			BackoffMax:   cfg.LoginBackoffMax,
+			Window:       cfg.LoginLockoutDuration,
+		},
+		Now: time.Now,
+	}
+}
+
+type UpdateUserRoleRequest struct {
+	Role string `json:"role" binding:"required"`
 }
 
 type LoginRequest struct {
@@ -30,6 +66,10 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	if !checkPasswordPolicy(c, "password", req.Username, req.Password) {
+		return
+	}
+
 	// Check if username already exists
 	var existingUser models.User
 	if err := database.DB.Where("username = ?", req.Username).First(&existingUser).Error; err == nil {
@@ -37,8 +77,14 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	// Email is optional but must be valid and unique when given
+	email, ok := checkEmail(c, req.Email, 0)
+	if !ok {
+		return
+	}
+
 	// Hash password
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	hashedPassword, err := passwordHasher().Hash(req.Password)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to hash password"})
 		return
@@ -47,7 +93,9 @@ func CreateUser(c *gin.Context) {
 	// Create user
 	user := models.User{
 		Username:  req.Username,
-		Password:  string(hashedPassword),
+		Email:     email,
+		Password:  hashedPassword,
+		Role:      models.RoleCustomer,
 		CreatedAt: time.Now(),
 	}
 
@@ -56,9 +104,15 @@ func CreateUser(c *gin.Context) {
 		return
 	}
 
+	// A guest cart sent along with the sign-up becomes the user's cart
+	cartMerge := mergeRequestGuestCart(c, &user)
+
 	// Return user without password
 	user.Password = ""
-	c.JSON(http.StatusCreated, user)
+	c.JSON(http.StatusCreated, struct {
+		models.User
+		CartMerge *CartMergeReport `json:"cart_merge,omitempty"`
+	}{user, cartMerge})
 }
 
 func ListUsers(c *gin.Context) {
@@ -76,6 +130,33 @@ func ListUsers(c *gin.Context) {
 	c.JSON(http.StatusOK, users)
 }
 
+func UpdateUserRole(c *gin.Context) {
+	var req UpdateUserRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !models.IsValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role: " + req.Role})
+		return
+	}
+
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := database.DB.Model(&user).Update("role", req.Role).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update role"})
+		return
+	}
+
+	user.Password = ""
+	c.JSON(http.StatusOK, user)
+}
+
 func Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -83,40 +164,123 @@ func Login(c *gin.Context) {
 		return
 	}
 
+	// Refuse attempts while the account is locked or backing off
+	wait, locked, err := LoginGuard.Check(req.Username, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check login attempts"})
+		return
+	}
+	if wait > 0 {
+		tooManyLoginAttempts(c, wait, locked)
+		return
+	}
+
 	// Find user
 	var user models.User
 	if err := database.DB.Where("username = ?", req.Username).First(&user).Error; err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+		loginFailed(c, req.Username, "Invalid username or password")
 		return
 	}
 
 	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid username or password"})
+	match, err := passwordHasher().Verify(user.Password, req.Password)
+	if err != nil {
+		log.Printf("Failed to verify password of user %d: %v", user.ID, err)
+	}
+	if !match {
+		loginFailed(c, req.Username, "Invalid username or password")
 		return
 	}
 
-	// Generate token
-	token, err := generateToken()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+	upgradePasswordHash(&user, req.Password)
+
+	// The failure counter is only reset once the second factor is checked
+	if user.TwoFactorEnabled {
+		startTwoFactorChallenge(c, &user)
 		return
 	}
 
-	// Update user token (this invalidates any previous token)
-	user.Token = &token
-	if err := database.DB.Save(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save token"})
+	if err := LoginGuard.Succeed(user.Username); err != nil {
+		log.Printf("Failed to reset login attempts for %q: %v", user.Username, err)
+	}
+
+	startSession(c, &user)
+}
+
+// UnlockUser clears a user's failed logins and lockout.
+func UnlockUser(c *gin.Context) {
+	var user models.User
+	if err := database.DB.Where("id = ?", c.Param("id")).First(&user).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"token": token,
-		"user": gin.H{
-			"id":       user.ID,
-			"username": user.Username,
-		},
-	})
+	if err := LoginGuard.Unlock(user.Username); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	admin, _ := c.Get("user")
+	log.Printf("SECURITY: account %q unlocked by %q", user.Username, admin.(*models.User).Username)
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked"})
+}
+
+// loginFailed counts a failed login for username and answers with 401 and
+// message, or with 429 when the failure locked the account. Unknown usernames
+// are counted too, so responses do not reveal which accounts exist.
+func loginFailed(c *gin.Context, username, message string) {
+	lockedUntil, err := LoginGuard.Fail(username, c.ClientIP())
+	if err != nil {
+		log.Printf("Failed to record failed login for %q: %v", username, err)
+	}
+
+	if !lockedUntil.IsZero() {
+		log.Printf("SECURITY: account %q locked until %s after repeated failed logins, last from %s",
+			username, lockedUntil.Format(time.RFC3339), c.ClientIP())
+		tooManyLoginAttempts(c, lockedUntil.Sub(LoginGuard.Now()), true)
+		return
+	}
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": message})
+}
+
+func tooManyLoginAttempts(c *gin.Context, wait time.Duration, locked bool) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Header("Retry-After", strconv.Itoa(seconds))
+
+	message := "Too many failed login attempts, try again later"
+	if locked {
+		message = "Account temporarily locked after too many failed login attempts"
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retry_after": seconds})
+}
+
+// checkEmail validates an optional email address and makes sure no user but
+// userID has it. It answers the request itself and returns false when the
+// address cannot be used; an empty address is returned as nil.
+func checkEmail(c *gin.Context, email string, userID uint) (*string, bool) {
+	if email == "" {
+		return nil, true
+	}
+
+	address, err := netmail.ParseAddress(email)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+		return nil, false
+	}
+
+	var count int
+	database.DB.Model(&models.User{}).Where("email = ? AND id <> ?", address.Address, userID).Count(&count)
+	if count > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Email already in use"})
+		return nil, false
+	}
+
+	return &address.Address, true
 }
 
 func generateToken() (string, error) {
@@ -126,4 +290,3 @@ func generateToken() (string, error) {
 	}
 	return hex.EncodeToString(bytes), nil
 }
-
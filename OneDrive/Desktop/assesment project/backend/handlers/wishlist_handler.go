@@ -0,0 +1,467 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"shopping-cart/database"
+	"shopping-cart/mail"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jinzhu/gorm"
+)
+
+type CreateWishlistRequest struct {
+	Name   string `json:"name" binding:"required"`
+	Notify bool   `json:"notify"`
+}
+
+// UpdateWishlistRequest holds the wishlist fields to change; fields left
+// out keep their value.
+type UpdateWishlistRequest struct {
+	Name   *string `json:"name"`
+	Notify *bool   `json:"notify"`
+}
+
+// WishlistItemRequest names an item and how many units to add or move. A
+// missing quantity means one unit when adding and the whole line when
+// moving.
+type WishlistItemRequest struct {
+	ItemID   uint `json:"item_id" binding:"required"`
+	Quantity *int `json:"quantity"`
+}
+
+func CreateWishlist(c *gin.Context) {
+	var req CreateWishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	name, ok := checkWishlistName(c, req.Name)
+	if !ok {
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	wishlist := models.Wishlist{
+		UserID:    currentUser.ID,
+		Name:      name,
+		Notify:    req.Notify,
+		CreatedAt: time.Now(),
+	}
+	if err := database.DB.Create(&wishlist).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create wishlist"})
+		return
+	}
+
+	wishlist, _ = loadWishlist(wishlist.ID)
+
+	c.JSON(http.StatusCreated, wishlist)
+}
+
+func ListWishlists(c *gin.Context) {
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	var wishlists []models.Wishlist
+	if err := database.DB.Where("user_id = ?", currentUser.ID).Preload("Items").Preload("Items.Item").Order("id").Find(&wishlists).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wishlists"})
+		return
+	}
+
+	c.JSON(http.StatusOK, wishlists)
+}
+
+func GetWishlist(c *gin.Context) {
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	wishlist, _ = loadWishlist(wishlist.ID)
+
+	c.JSON(http.StatusOK, wishlist)
+}
+
+func UpdateWishlist(c *gin.Context) {
+	var req UpdateWishlistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	updates := map[string]interface{}{}
+
+	if req.Name != nil {
+		name, ok := checkWishlistName(c, *req.Name)
+		if !ok {
+			return
+		}
+		updates["name"] = name
+	}
+
+	if req.Notify != nil {
+		updates["notify"] = *req.Notify
+	}
+
+	if len(updates) > 0 {
+		if err := database.DB.Model(&models.Wishlist{}).Where("id = ?", wishlist.ID).Updates(updates).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update wishlist"})
+			return
+		}
+	}
+
+	wishlist, _ = loadWishlist(wishlist.ID)
+
+	c.JSON(http.StatusOK, wishlist)
+}
+
+func DeleteWishlist(c *gin.Context) {
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := tx.Where("wishlist_id = ?", wishlist.ID).Delete(&models.WishlistItem{}).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wishlist"})
+		return
+	}
+	if err := tx.Delete(&wishlist).Error; err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wishlist"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete wishlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Wishlist deleted"})
+}
+
+// AddWishlistItem puts an item on the wishlist, adding to the quantity of
+// an item that is already there. Inactive items may be listed, so the user
+// can be told when they come back.
+func AddWishlistItem(c *gin.Context) {
+	var req WishlistItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	quantity := 1
+	if req.Quantity != nil {
+		quantity = *req.Quantity
+	}
+	if quantity < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Quantity must be at least 1"})
+		return
+	}
+	if quantity > models.MaxLineQuantity {
+		c.JSON(http.StatusBadRequest, gin.H{"error": quantityTooLarge})
+		return
+	}
+
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	var item models.Item
+	if err := database.DB.First(&item, req.ItemID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not found"})
+		return
+	}
+
+	if err := addWishlistLine(database.DB, wishlist.ID, item.ID, quantity); err == errQuantityTooLarge {
+		c.JSON(http.StatusBadRequest, gin.H{"error": quantityTooLarge})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to wishlist"})
+		return
+	}
+
+	wishlist, _ = loadWishlist(wishlist.ID)
+
+	c.JSON(http.StatusOK, wishlist)
+}
+
+func RemoveWishlistItem(c *gin.Context) {
+	itemID, err := strconv.ParseUint(c.Param("item_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid item ID"})
+		return
+	}
+
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	result := database.DB.Where("wishlist_id = ? AND item_id = ?", wishlist.ID, itemID).Delete(&models.WishlistItem{})
+	if result.Error != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove item from wishlist"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in wishlist"})
+		return
+	}
+
+	wishlist, _ = loadWishlist(wishlist.ID)
+
+	c.JSON(http.StatusOK, wishlist)
+}
+
+// MoveWishlistItemToCart moves units of a wishlist item into the user's
+// active cart, adding to the cart line like POST /carts does.
+func MoveWishlistItemToCart(c *gin.Context) {
+	var req WishlistItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	var line models.WishlistItem
+	if err := database.DB.Where("wishlist_id = ? AND item_id = ?", wishlist.ID, req.ItemID).Preload("Item").First(&line).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in wishlist"})
+		return
+	}
+
+	quantity, ok := moveQuantity(c, req.Quantity, line.Quantity)
+	if !ok {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	cart, err := userCart(tx, currentUser)
+	if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create cart"})
+		return
+	}
+
+	if _, _, err := addCartLine(tx, requestActor(c), cart.ID, line.Item, quantity); err != nil {
+		tx.Rollback()
+		writeCartLineError(c, line.Item, err)
+		return
+	}
+	if err := setWishlistLineQuantity(tx, line, line.Quantity-quantity); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update wishlist"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item to cart"})
+		return
+	}
+
+	writeWishlistAndCart(c, wishlist.ID, cart.ID)
+}
+
+// MoveCartItemToWishlist saves units of a line of the user's active cart for
+// later, taking them out of the cart and releasing their stock hold.
+func MoveCartItemToWishlist(c *gin.Context) {
+	var req WishlistItemRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, _ := c.Get("user")
+	currentUser := user.(*models.User)
+
+	wishlist, ok := findWishlist(c)
+	if !ok {
+		return
+	}
+
+	if currentUser.CartID == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No active cart"})
+		return
+	}
+
+	var cartItem models.CartItem
+	if err := database.DB.Where("cart_id = ? AND item_id = ?", *currentUser.CartID, req.ItemID).First(&cartItem).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Item not in cart"})
+		return
+	}
+
+	quantity, ok := moveQuantity(c, req.Quantity, cartItem.Quantity)
+	if !ok {
+		return
+	}
+
+	tx := database.DB.Begin()
+
+	if err := setCartLineQuantity(tx, requestActor(c), cartItem, cartItem.Quantity-quantity); err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update cart item"})
+		return
+	}
+	if err := addWishlistLine(tx, wishlist.ID, cartItem.ItemID, quantity); err == errQuantityTooLarge {
+		tx.Rollback()
+		c.JSON(http.StatusBadRequest, gin.H{"error": quantityTooLarge})
+		return
+	} else if err != nil {
+		tx.Rollback()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add item to wishlist"})
+		return
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to move item to wishlist"})
+		return
+	}
+
+	writeWishlistAndCart(c, wishlist.ID, cartItem.CartID)
+}
+
+// findWishlist loads the current user's wishlist named by the id parameter.
+func findWishlist(c *gin.Context) (models.Wishlist, bool) {
+	var wishlist models.Wishlist
+	wishlistID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid wishlist ID"})
+		return wishlist, false
+	}
+
+	user, _ := c.Get("user")
+	if err := database.DB.Where("id = ? AND user_id = ?", wishlistID, user.(*models.User).ID).First(&wishlist).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wishlist not found"})
+		return wishlist, false
+	}
+	return wishlist, true
+}
+
+func loadWishlist(wishlistID uint) (models.Wishlist, error) {
+	var wishlist models.Wishlist
+	err := database.DB.Where("id = ?", wishlistID).Preload("Items").Preload("Items.Item").First(&wishlist).Error
+	return wishlist, err
+}
+
+func writeWishlistAndCart(c *gin.Context, wishlistID, cartID uint) {
+	wishlist, _ := loadWishlist(wishlistID)
+	cart, _ := loadCart(cartID)
+
+	c.JSON(http.StatusOK, gin.H{"wishlist": wishlist, "cart": cart})
+}
+
+func checkWishlistName(c *gin.Context, name string) (string, bool) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wishlist name cannot be empty"})
+		return "", false
+	}
+	if len(name) > 100 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Wishlist name must be at most 100 characters"})
+		return "", false
+	}
+	return name, true
+}
+
+// moveQuantity resolves how many of the available units to move; nil means
+// all of them.
+func moveQuantity(c *gin.Context, requested *int, available int) (int, bool) {
+	if requested == nil {
+		return available, true
+	}
+	if *requested < 1 || *requested > available {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Quantity must be between 1 and %d", available)})
+		return 0, false
+	}
+	return *requested, true
+}
+
+// addWishlistLine adds quantity units of an item to the wishlist, summing
+// with the line already there. Lines that would exceed MaxLineQuantity fail
+// with errQuantityTooLarge.
+func addWishlistLine(db *gorm.DB, wishlistID, itemID uint, quantity int) error {
+	var line models.WishlistItem
+	if err := db.Where("wishlist_id = ? AND item_id = ?", wishlistID, itemID).First(&line).Error; err != nil {
+		line = models.WishlistItem{
+			WishlistID: wishlistID,
+			ItemID:     itemID,
+			Quantity:   quantity,
+			CreatedAt:  time.Now(),
+		}
+		return db.Create(&line).Error
+	}
+	if line.Quantity+quantity > models.MaxLineQuantity {
+		return errQuantityTooLarge
+	}
+	return db.Model(&models.WishlistItem{}).Where("id = ?", line.ID).Update("quantity", line.Quantity+quantity).Error
+}
+
+// setWishlistLineQuantity changes the quantity of a wishlist line; zero
+// removes it.
+func setWishlistLineQuantity(db *gorm.DB, line models.WishlistItem, quantity int) error {
+	if quantity == 0 {
+		return db.Where("id = ?", line.ID).Delete(&models.WishlistItem{}).Error
+	}
+	return db.Model(&models.WishlistItem{}).Where("id = ?", line.ID).Update("quantity", quantity).Error
+}
+
+// notifyWishlistWatchers queues an email to the users who asked to hear
+// about item when an update makes it active again or lowers its price.
+func notifyWishlistWatchers(before, after models.Item) {
+	var reason string
+	switch {
+	case !before.IsActive() && after.IsActive():
+		reason = after.Name + " is available again at " + after.UnitPrice().String() + "."
+	case after.IsActive() && after.Currency == before.Currency && after.Price < before.Price:
+		reason = after.Name + " dropped in price from " + before.UnitPrice().String() + " to " + after.UnitPrice().String() + "."
+	default:
+		return
+	}
+
+	watchers := database.DB.Table("wishlists").
+		Select("wishlists.user_id").
+		Joins("JOIN wishlist_items ON wishlist_items.wishlist_id = wishlists.id").
+		Where("wishlists.notify = ? AND wishlist_items.item_id = ?", true, after.ID).
+		QueryExpr()
+
+	var users []models.User
+	if err := database.DB.Where("id IN (?) AND email IS NOT NULL", watchers).Find(&users).Error; err != nil {
+		log.Printf("Failed to find wishlist watchers of item %d: %v", after.ID, err)
+		return
+	}
+
+	for _, user := range users {
+		msg := mail.Message{
+			To:      *user.Email,
+			Subject: "An item on your wishlist: " + after.Name,
+			Body:    fmt.Sprintf("Hello %s,\n\n%s\n\nYou get this email because you turned on notifications for a wishlist holding this item.\n", user.Username, reason),
+		}
+		if err := queueEmail(database.DB, user.ID, msg); err != nil {
+			log.Printf("Failed to queue wishlist notification to user %d: %v", user.ID, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package mail
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+)
+
+// Message is a plain-text email.
+type Message struct {
+	From    string
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. Handlers only depend on this interface so the
+// transport can be swapped per environment.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Bytes renders the message in RFC 5322 format. Header values cannot break
+// out of their line: line breaks are dropped from the addresses, and a
+// subject with line breaks or non-ASCII text is sent as an encoded word.
+func (m Message) Bytes() []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", stripLineBreaks(m.From))
+	fmt.Fprintf(&b, "To: %s\r\n", stripLineBreaks(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+func stripLineBreaks(value string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(value)
+}
@@ -0,0 +1,40 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// OutboxMailer writes every message to a .eml file in Dir instead of
+// sending it, for local development and tests.
+type OutboxMailer struct {
+	Dir  string
+	From string
+}
+
+var outboxSequence uint64
+
+func (m *OutboxMailer) Send(msg Message) error {
+	if msg.From == "" {
+		msg.From = m.From
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%d.eml", time.Now().UnixNano(), atomic.AddUint64(&outboxSequence, 1))
+	return os.WriteFile(filepath.Join(m.Dir, name), msg.Bytes(), 0o600)
+}
+
+// Messages returns the paths of the messages in the outbox, oldest first.
+func (m *OutboxMailer) Messages() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(m.Dir, "*.eml"))
+	if err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
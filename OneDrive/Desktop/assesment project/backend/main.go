@@ -2,31 +2,91 @@ package main
 
 import (
 	"log"
+	"time"
 
+	"shopping-cart/config"
 	"shopping-cart/database"
 	"shopping-cart/handlers"
+	"shopping-cart/mail"
 	"shopping-cart/middleware"
+	"shopping-cart/models"
 
 	"github.com/gin-gonic/gin"
 )
 
 func main() {
+	// Load configuration
+	config.Load()
+
 	// Initialize database
 	database.InitDB()
 	defer database.DB.Close()
 
 	// Seed data
 	database.SeedData()
+	if config.Current.AdminUsername != "" && config.Current.AdminPassword != "" {
+		database.SeedAdmin(config.Current.AdminUsername, config.Current.AdminPassword)
+	}
+
+	// Throttle failed logins with the configured limits
+	handlers.LoginGuard = handlers.NewLoginGuard(config.Current)
+
+	// Configure mail delivery
+	if config.Current.MailDriver == "smtp" {
+		handlers.Mailer = &mail.SMTPMailer{
+			Addr:     config.Current.SMTPAddr,
+			From:     config.Current.MailFrom,
+			Username: config.Current.SMTPUsername,
+			Password: config.Current.SMTPPassword,
+		}
+	} else {
+		handlers.Mailer = &mail.OutboxMailer{Dir: config.Current.MailOutboxDir, From: config.Current.MailFrom}
+	}
+
+	// Send queued emails in the background
+	go func() {
+		for range time.Tick(config.Current.MailQueueInterval) {
+			handlers.SendQueuedEmails()
+		}
+	}()
+
+	// Release expired stock holds in the background
+	if config.Current.StockHoldsEnabled {
+		go func() {
+			for range time.Tick(config.Current.StockHoldSweepInterval) {
+				database.ReleaseExpiredStockHolds()
+			}
+		}()
+	}
+
+	// Delete guest carts whose token has expired
+	go func() {
+		for range time.Tick(config.Current.GuestCartSweepInterval) {
+			database.DeleteExpiredGuestCarts()
+		}
+	}()
 
 	// Setup router
 	r := gin.Default()
+	registerRoutes(r)
+
+	// Start server
+	port := ":8080"
+	log.Printf("Server starting on port %s", port)
+	if err := r.Run(port); err != nil {
+		log.Fatal("Failed to start server:", err)
+	}
+}
 
+// registerRoutes installs the middleware and every API route on r. The tests
+// use it too, so they exercise the same wiring as the server.
+func registerRoutes(r *gin.Engine) {
 	// CORS middleware
 	r.Use(func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, accept, origin, Cache-Control, X-Requested-With")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, Idempotency-Key, X-API-Key, X-Cart-Token, accept, origin, Cache-Control, X-Requested-With")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
 
 		if c.Request.Method == "OPTIONS" {
 			c.AbortWithStatus(204)
@@ -45,39 +105,139 @@ func main() {
 	userRoutes := r.Group("/users")
 	{
 		userRoutes.POST("", handlers.CreateUser)
-		userRoutes.GET("", handlers.ListUsers)
+		userRoutes.GET("", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermUsersRead), handlers.ListUsers)
 		userRoutes.POST("/login", handlers.Login)
+		userRoutes.POST("/login/2fa", handlers.LoginTwoFactor)
+		userRoutes.POST("/token/refresh", handlers.RefreshToken)
+		userRoutes.POST("/password/forgot", handlers.ForgotPassword)
+		userRoutes.POST("/password/reset", handlers.ResetPassword)
+		userRoutes.POST("/logout", middleware.AuthMiddleware(), handlers.Logout)
+		userRoutes.PUT("/:id/role", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermUsersManage), handlers.UpdateUserRole)
+		userRoutes.POST("/:id/unlock", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermUsersManage), handlers.UnlockUser)
+		userRoutes.GET("/:id/export", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermUsersManage), handlers.ExportUserData)
+	}
+
+	// Current user routes (require authentication)
+	meRoutes := r.Group("/users/me")
+	meRoutes.Use(middleware.AuthMiddleware(), middleware.LoadUser())
+	{
+		meRoutes.GET("", handlers.GetProfile)
+		meRoutes.PATCH("", handlers.UpdateProfile)
+		meRoutes.DELETE("", handlers.DeleteAccount)
+		meRoutes.POST("/password", handlers.ChangePassword)
+		meRoutes.GET("/export", handlers.ExportMyData)
+		meRoutes.GET("/sessions", handlers.ListSessions)
+		meRoutes.DELETE("/sessions/:id", handlers.RevokeSession)
+		meRoutes.POST("/2fa/enroll", handlers.EnrollTwoFactor)
+		meRoutes.POST("/2fa/verify", handlers.VerifyTwoFactor)
+		meRoutes.DELETE("/2fa", handlers.DisableTwoFactor)
+		meRoutes.POST("/api-keys", handlers.CreateAPIKey)
+		meRoutes.GET("/api-keys", handlers.ListAPIKeys)
+		meRoutes.DELETE("/api-keys/:id", handlers.RevokeAPIKey)
 	}
 
 	// Item routes
 	itemRoutes := r.Group("/items")
 	{
-		itemRoutes.POST("", handlers.CreateItem)
+		itemRoutes.POST("", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermItemsWrite), handlers.CreateItem)
 		itemRoutes.GET("", handlers.ListItems)
+		itemRoutes.PATCH("/:id", middleware.AuthMiddleware(), middleware.RequirePermission(models.PermItemsWrite), handlers.UpdateItem)
+	}
+
+	// Guest cart routes, authorized by the signed cart token
+	guestCartRoutes := r.Group("/carts/guest")
+	{
+		guestCartRoutes.POST("", handlers.AddGuestCartItems)
+		guestCartRoutes.GET("", handlers.GetGuestCart)
+		guestCartRoutes.PATCH("/items/:item_id", handlers.UpdateGuestCartItem)
+		guestCartRoutes.DELETE("/items/:item_id", handlers.RemoveGuestCartItem)
 	}
 
 	// Cart routes (require authentication)
 	cartRoutes := r.Group("/carts")
-	cartRoutes.Use(middleware.AuthMiddleware())
+	cartRoutes.Use(middleware.AuthMiddleware(), middleware.LoadUser())
 	{
-		cartRoutes.POST("", handlers.CreateCart)
+		cartRoutes.POST("", middleware.Idempotency(), handlers.CreateCart)
 		cartRoutes.GET("", handlers.ListCarts)
+		cartRoutes.POST("/new", handlers.CreateNamedCart)
 		cartRoutes.GET("/me", handlers.GetUserCart)
+		cartRoutes.PATCH("/me/items/:item_id", handlers.UpdateCartItem)
+		cartRoutes.DELETE("/me/items/:item_id", handlers.RemoveCartItem)
+		cartRoutes.GET("/shared", handlers.ListSharedCarts)
+		cartRoutes.GET("/:id", handlers.GetCart)
+		cartRoutes.PATCH("/:id", handlers.RenameCart)
+		cartRoutes.DELETE("/:id", handlers.DeleteCart)
+		cartRoutes.POST("/:id/activate", handlers.ActivateCart)
+		cartRoutes.POST("/:id/items", handlers.AddCartItemsByID)
+		cartRoutes.PATCH("/:id/items/:item_id", handlers.UpdateCartItemByID)
+		cartRoutes.DELETE("/:id/items/:item_id", handlers.RemoveCartItemByID)
+		cartRoutes.GET("/:id/changes", handlers.ListCartChanges)
+		cartRoutes.POST("/:id/shares", handlers.CreateCartShare)
+		cartRoutes.GET("/:id/shares", handlers.ListCartShares)
+		cartRoutes.DELETE("/:id/shares/:share_id", handlers.RevokeCartShare)
+		cartRoutes.POST("/:id/collaborators", handlers.AddCartCollaborator)
+		cartRoutes.GET("/:id/collaborators", handlers.ListCartCollaborators)
+		cartRoutes.DELETE("/:id/collaborators/:user_id", handlers.RemoveCartCollaborator)
+	}
+
+	// Shared cart routes, authorized by the share link token
+	sharedCartRoutes := r.Group("/shared-carts/:token")
+	{
+		sharedCartRoutes.GET("", handlers.GetSharedCart)
+		sharedCartRoutes.POST("/items", handlers.AddSharedCartItems)
+		sharedCartRoutes.PATCH("/items/:item_id", handlers.UpdateSharedCartItem)
+		sharedCartRoutes.DELETE("/items/:item_id", handlers.RemoveSharedCartItem)
+	}
+
+	// Wishlist routes (require authentication)
+	wishlistRoutes := r.Group("/wishlists")
+	wishlistRoutes.Use(middleware.AuthMiddleware(), middleware.LoadUser())
+	{
+		wishlistRoutes.POST("", handlers.CreateWishlist)
+		wishlistRoutes.GET("", handlers.ListWishlists)
+		wishlistRoutes.GET("/:id", handlers.GetWishlist)
+		wishlistRoutes.PATCH("/:id", handlers.UpdateWishlist)
+		wishlistRoutes.DELETE("/:id", handlers.DeleteWishlist)
+		wishlistRoutes.POST("/:id/items", handlers.AddWishlistItem)
+		wishlistRoutes.DELETE("/:id/items/:item_id", handlers.RemoveWishlistItem)
+		wishlistRoutes.POST("/:id/move-to-cart", handlers.MoveWishlistItemToCart)
+		wishlistRoutes.POST("/:id/move-from-cart", handlers.MoveCartItemToWishlist)
 	}
 
 	// Order routes (require authentication)
 	orderRoutes := r.Group("/orders")
 	orderRoutes.Use(middleware.AuthMiddleware())
 	{
-		orderRoutes.POST("", handlers.CreateOrder)
+		orderRoutes.POST("", middleware.Idempotency(), handlers.CreateOrder)
 		orderRoutes.GET("", handlers.ListOrders)
+		orderRoutes.POST("/:id/transitions", middleware.RequirePermission(models.PermOrdersManage), handlers.TransitionOrder)
+		orderRoutes.GET("/:id/history", handlers.GetOrderHistory)
 	}
 
-	// Start server
-	port := ":8080"
-	log.Printf("Server starting on port %s", port)
-	if err := r.Run(port); err != nil {
-		log.Fatal("Failed to start server:", err)
-	}
+	// Routes API keys may call, with the scope each needs; API keys are
+	// rejected everywhere else
+	middleware.AllowAPIKeys(map[string]string{
+		"GET /users":                       models.ScopeUsersRead,
+		"POST /items":                      models.ScopeItemsWrite,
+		"PATCH /items/:id":                 models.ScopeItemsWrite,
+		"POST /carts":                      models.ScopeCartsWrite,
+		"GET /carts":                       models.ScopeCartsRead,
+		"GET /carts/me":                    models.ScopeCartsRead,
+		"PATCH /carts/me/items/:item_id":   models.ScopeCartsWrite,
+		"DELETE /carts/me/items/:item_id":  models.ScopeCartsWrite,
+		"POST /carts/new":                  models.ScopeCartsWrite,
+		"GET /carts/:id":                   models.ScopeCartsRead,
+		"PATCH /carts/:id":                 models.ScopeCartsWrite,
+		"DELETE /carts/:id":                models.ScopeCartsWrite,
+		"POST /carts/:id/activate":         models.ScopeCartsWrite,
+		"GET /carts/shared":                models.ScopeCartsRead,
+		"POST /carts/:id/items":            models.ScopeCartsWrite,
+		"PATCH /carts/:id/items/:item_id":  models.ScopeCartsWrite,
+		"DELETE /carts/:id/items/:item_id": models.ScopeCartsWrite,
+		"GET /carts/:id/changes":           models.ScopeCartsRead,
+		"POST /orders":                     models.ScopeOrdersWrite,
+		"GET /orders":                      models.ScopeOrdersRead,
+		"POST /orders/:id/transitions":     models.ScopeOrdersManage,
+		"GET /orders/:id/history":          models.ScopeOrdersRead,
+	})
 }
-
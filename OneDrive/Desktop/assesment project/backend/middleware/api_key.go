@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// APIKeyHeader carries an API key. Keys are also accepted as a bearer token
+// since they start with models.APIKeyPrefix.
+const APIKeyHeader = "X-API-Key"
+
+// apiKeyScopes maps "METHOD /route" to the scope an API key needs to call
+// it. Routes that are not listed reject API keys.
+var apiKeyScopes = map[string]string{}
+
+// AllowAPIKeys registers the routes API keys may call, keyed by method and
+// route pattern (e.g. "GET /orders"), with the scope each one needs.
+func AllowAPIKeys(routes map[string]string) {
+	for route, scope := range routes {
+		apiKeyScopes[route] = scope
+	}
+}
+
+// authenticateAPIKey authenticates the request as the key's owner after
+// checking that the route accepts API keys and the key has its scope.
+func authenticateAPIKey(c *gin.Context, key string) {
+	var apiKey models.APIKey
+	if err := database.DB.Where("key_hash = ?", models.HashSessionToken(key)).Preload("User").First(&apiKey).Error; err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+		c.Abort()
+		return
+	}
+
+	now := time.Now()
+	if apiKey.IsExpired(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "API key has expired"})
+		c.Abort()
+		return
+	}
+
+	scope, allowed := apiKeyScopes[c.Request.Method+" "+c.FullPath()]
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot be used for this endpoint"})
+		c.Abort()
+		return
+	}
+	if !apiKey.HasScope(scope) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API key is missing scope: " + scope})
+		c.Abort()
+		return
+	}
+
+	database.DB.Model(&apiKey).UpdateColumn("last_used_at", now)
+
+	user := apiKey.User
+	c.Set("user", &user)
+	c.Set("user_id", user.ID)
+	c.Set("api_key_id", apiKey.ID)
+	c.Next()
+}
@@ -3,7 +3,10 @@ package middleware
 import (
 	"net/http"
 	"strings"
+	"time"
 
+	"shopping-cart/auth"
+	"shopping-cart/config"
 	"shopping-cart/database"
 	"shopping-cart/models"
 
@@ -12,6 +15,11 @@ import (
 
 func AuthMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if apiKey := c.GetHeader(APIKeyHeader); apiKey != "" {
+			authenticateAPIKey(c, strings.TrimSpace(apiKey))
+			return
+		}
+
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
@@ -33,18 +41,90 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Find user by token
-		var user models.User
-		if err := database.DB.Where("token = ?", token).First(&user).Error; err != nil {
+		if strings.HasPrefix(token, models.APIKeyPrefix) {
+			authenticateAPIKey(c, token)
+			return
+		}
+
+		if config.Current.AuthMode == config.AuthModeJWT {
+			authenticateAccessToken(c, token)
+			return
+		}
+
+		// Find session by token
+		var session models.Session
+		if err := database.DB.Where("token_hash = ?", models.HashSessionToken(token)).Preload("User").First(&session).Error; err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
 			c.Abort()
 			return
 		}
 
-		// Inject user into context
+		now := time.Now()
+		if session.IsExpired(now) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has expired"})
+			c.Abort()
+			return
+		}
+
+		database.DB.Model(&session).UpdateColumn("last_used_at", now)
+
+		// Inject user and session into context
+		user := session.User
 		c.Set("user", &user)
 		c.Set("user_id", user.ID)
+		c.Set("session_id", session.ID)
 		c.Next()
 	}
 }
 
+// authenticateAccessToken accepts a signed JWT without touching the
+// database. The user in the context only carries the ID, username and role
+// from the claims; routes that need the full record add LoadUser. Since the
+// session is not looked up, a revoked session's access tokens keep working
+// until they expire.
+func authenticateAccessToken(c *gin.Context, token string) {
+	claims, err := auth.ParseHS256(token, config.Current.JWTSecret, config.Current.JWTIssuer, time.Now())
+	if err == auth.ErrTokenExpired {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token has expired"})
+		c.Abort()
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		c.Abort()
+		return
+	}
+
+	user := models.User{
+		ID:       claims.Subject,
+		Username: claims.Username,
+		Role:     claims.Role,
+	}
+	c.Set("user", &user)
+	c.Set("user_id", user.ID)
+	c.Set("session_id", claims.SessionID)
+	c.Set("user_from_claims", true)
+	c.Next()
+}
+
+// LoadUser replaces a user built from token claims with the full database
+// record. It is a no-op for opaque sessions, which already load the user.
+func LoadUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool("user_from_claims") {
+			c.Next()
+			return
+		}
+
+		var user models.User
+		if err := database.DB.First(&user, c.GetUint("user_id")).Error; err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User no longer exists"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user", &user)
+		c.Set("user_from_claims", false)
+		c.Next()
+	}
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"shopping-cart/config"
+	"shopping-cart/database"
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// responseRecorder copies everything written to the client into body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *responseRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *responseRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Idempotency replays the stored response when a request is retried with
+// the same Idempotency-Key header. Keys are scoped to the authenticated user,
+// so it must run after AuthMiddleware. Requests without the header pass
+// through untouched.
+func Idempotency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			c.Next()
+			return
+		}
+
+		if len(key) > 255 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			c.Abort()
+			return
+		}
+
+		userID := c.GetUint("user_id")
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "?" + c.Request.URL.RawQuery + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		now := time.Now()
+
+		// Drop this user's expired keys so they can be reused
+		database.DB.Where("user_id = ? AND expires_at <= ?", userID, now).Delete(&models.IdempotencyKey{})
+
+		var stored models.IdempotencyKey
+		if err := database.DB.Where("user_id = ? AND key = ?", userID, key).First(&stored).Error; err == nil {
+			respondWithStoredKey(c, &stored, requestHash)
+			return
+		}
+
+		stored = models.IdempotencyKey{
+			UserID:      userID,
+			Key:         key,
+			RequestHash: requestHash,
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(config.Current.IdempotencyKeyTTL),
+		}
+		if err := database.DB.Create(&stored).Error; err != nil {
+			// A concurrent request with the same key got there first
+			if err := database.DB.Where("user_id = ? AND key = ?", userID, key).First(&stored).Error; err == nil {
+				respondWithStoredKey(c, &stored, requestHash)
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store idempotency key"})
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		// Server errors are not stored, so the client can retry with the same key
+		if recorder.Status() >= http.StatusInternalServerError {
+			database.DB.Delete(&stored)
+			return
+		}
+
+		database.DB.Model(&stored).Updates(map[string]interface{}{
+			"status_code":   recorder.Status(),
+			"content_type":  recorder.Header().Get("Content-Type"),
+			"response_body": recorder.body.String(),
+		})
+	}
+}
+
+func respondWithStoredKey(c *gin.Context, stored *models.IdempotencyKey, requestHash string) {
+	if stored.RequestHash != requestHash {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was already used with a different request"})
+		c.Abort()
+		return
+	}
+
+	if stored.StatusCode == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being processed"})
+		c.Abort()
+		return
+	}
+
+	c.Header("Idempotent-Replayed", "true")
+	c.Data(stored.StatusCode, stored.ContentType, []byte(stored.ResponseBody))
+	c.Abort()
+}
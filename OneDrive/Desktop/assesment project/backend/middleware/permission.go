@@ -0,0 +1,30 @@
+package middleware
+
+import (
+	"net/http"
+
+	"shopping-cart/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequirePermission rejects the request with 403 unless the authenticated
+// user holds permission. It must run after AuthMiddleware.
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, exists := c.Get("user")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "User not found in context"})
+			c.Abort()
+			return
+		}
+
+		if !user.(*models.User).Can(permission) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Missing permission: " + permission})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
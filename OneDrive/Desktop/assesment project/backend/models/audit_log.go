@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// Audit log actions
+const (
+	AuditActionUserExport = "user.export"
+)
+
+// AuditLog records a sensitive action: who did it, to which user, and when.
+type AuditLog struct {
+	ID            uint      `gorm:"primary_key" json:"id"`
+	ActorID       uint      `gorm:"not null;index" json:"actor_id"`
+	Action        string    `gorm:"not null;index" json:"action"`
+	SubjectUserID uint      `gorm:"not null;index" json:"subject_user_id"`
+	Details       string    `json:"details"`
+	IPAddress     string    `json:"ip_address"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (AuditLog) TableName() string {
+	return "audit_logs"
+}
@@ -1,6 +1,10 @@
 package models
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
 	"time"
 
 	_ "github.com/jinzhu/gorm"
@@ -13,13 +17,146 @@ type Cart struct {
 	Status    string    `json:"status"`
 	CreatedAt time.Time `json:"created_at"`
 
+	// Guest carts belong to a visitor holding a signed cart token instead of
+	// a user, and have no user_id. Carts of deleted users also have none but
+	// are not guest carts. A guest cart is deleted once its newest token
+	// expires at ExpiresAt.
+	Guest     bool       `gorm:"not null;default:false" json:"guest,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Whether this is the owner's active cart, set by the handlers
+	Active bool `gorm:"-" json:"active"`
+
+	// Computed fields, populated by ComputeTotals
+	TotalQuantity int             `gorm:"-" json:"total_quantity"`
+	Total         *Money          `gorm:"-" json:"total"`
+	StockWarnings []StockShortage `gorm:"-" json:"stock_warnings,omitempty"`
+
+	// Populated by Revalidate
+	Issues  []CartIssue `gorm:"-" json:"issues,omitempty"`
+	Version string      `gorm:"-" json:"version,omitempty"`
+
 	// Relationships
-	User      User       `gorm:"foreignkey:UserID" json:"user,omitempty"`
-	CartItems []CartItem `gorm:"foreignkey:CartID" json:"cart_items,omitempty"`
-	Orders    []Order    `gorm:"foreignkey:CartID" json:"-"`
+	User      *User       `gorm:"foreignkey:UserID" json:"user,omitempty"`
+	Owner     *PublicUser `gorm:"foreignkey:UserID" json:"owner,omitempty"`
+	CartItems []CartItem  `gorm:"foreignkey:CartID" json:"cart_items,omitempty"`
+	Orders    []Order     `gorm:"foreignkey:CartID" json:"-"`
 }
 
 func (Cart) TableName() string {
 	return "carts"
 }
 
+// DefaultCartName names carts created without a name.
+const DefaultCartName = "My Cart"
+
+// Cart statuses
+const (
+	CartStatusActive     = "active"
+	CartStatusCheckedOut = "checked_out"
+	CartStatusCompleted  = "completed"
+)
+
+// Problems Revalidate finds with a cart line
+const (
+	CartIssueRemoved      = "removed"
+	CartIssueInactive     = "inactive"
+	CartIssuePriceChanged = "price_changed"
+)
+
+// CartIssue flags a cart line whose item changed since it was added.
+// AddedPrice and CurrentPrice are set for price changes.
+type CartIssue struct {
+	ItemID       uint   `json:"item_id"`
+	Issue        string `json:"issue"`
+	AddedPrice   *Money `json:"added_price,omitempty"`
+	CurrentPrice *Money `json:"current_price,omitempty"`
+}
+
+// ComputeTotals fills in the computed fields from the loaded CartItems.
+// Lines whose item was removed or deactivated are left out, as checkout
+// drops them. Total is left nil when the lines are priced in more than one
+// currency.
+func (c *Cart) ComputeTotals() {
+	c.TotalQuantity = 0
+	subtotals := make([]Money, 0, len(c.CartItems))
+	for i := range c.CartItems {
+		cartItem := &c.CartItems[i]
+		cartItem.Subtotal = nil
+		if cartItem.Item.ID == 0 || !cartItem.Item.IsActive() {
+			continue
+		}
+		subtotal := cartItem.Item.UnitPrice().Mul(cartItem.Quantity)
+		cartItem.Subtotal = &subtotal
+		subtotals = append(subtotals, subtotal)
+		c.TotalQuantity += cartItem.Quantity
+	}
+
+	c.Total = nil
+	currency := DefaultCurrency
+	if len(subtotals) > 0 {
+		currency = subtotals[0].Currency
+	}
+	if total, err := Sum(currency, subtotals...); err == nil {
+		c.Total = &total
+	}
+}
+
+// CheckStock fills in StockWarnings with the lines that ask for more than
+// the item currently has in stock.
+func (c *Cart) CheckStock() {
+	c.StockWarnings = nil
+	for _, cartItem := range c.CartItems {
+		if shortage, short := NewStockShortage(cartItem.Item, cartItem.Quantity); short {
+			c.StockWarnings = append(c.StockWarnings, shortage)
+		}
+	}
+}
+
+// Revalidate compares the loaded CartItems with their items as they are now
+// and fills in Issues. Version identifies the lines and the state of their
+// items, so a client can show that it has seen the issues by sending it back
+// at checkout. Lines whose item no longer exists have a zero Item.
+func (c *Cart) Revalidate() {
+	c.Issues = nil
+	state := make([]string, 0, len(c.CartItems))
+	for _, cartItem := range c.CartItems {
+		item := cartItem.Item
+		issue := CartIssue{ItemID: cartItem.ItemID}
+		switch {
+		case item.ID == 0:
+			issue.Issue = CartIssueRemoved
+		case !item.IsActive():
+			issue.Issue = CartIssueInactive
+		case cartItem.AddedPrice.Currency != "" && cartItem.AddedPrice != item.UnitPrice():
+			added, current := cartItem.AddedPrice, item.UnitPrice()
+			issue.Issue, issue.AddedPrice, issue.CurrentPrice = CartIssuePriceChanged, &added, &current
+		}
+		if issue.Issue != "" {
+			c.Issues = append(c.Issues, issue)
+		}
+
+		state = append(state, fmt.Sprintf("%d:%d:%s:%d:%s", cartItem.ItemID, cartItem.Quantity, item.Status, item.Price, item.Currency))
+	}
+
+	// Lines are loaded in different orders by different handlers
+	sort.Strings(state)
+	sum := sha256.New()
+	for _, line := range state {
+		fmt.Fprintln(sum, line)
+	}
+	c.Version = hex.EncodeToString(sum.Sum(nil)[:16])
+}
+
+// IsOpen reports whether the cart can still be changed and checked out.
+func (c *Cart) IsOpen() bool {
+	return c.Status == CartStatusActive
+}
+
+// Currency returns the currency of the cart's lines, or "" for an empty cart.
+func (c *Cart) Currency() string {
+	if len(c.CartItems) == 0 {
+		return ""
+	}
+	return c.CartItems[0].Item.UnitPrice().Currency
+}
@@ -4,10 +4,23 @@ import (
 	_ "github.com/jinzhu/gorm"
 )
 
+// MaxLineQuantity caps the quantity of a cart or wishlist line, far below
+// what would overflow a line total or the quantity column.
+const MaxLineQuantity = 9999
+
 type CartItem struct {
-	ID     uint `gorm:"primary_key" json:"id"`
-	CartID uint `gorm:"not null" json:"cart_id"`
-	ItemID uint `gorm:"not null" json:"item_id"`
+	ID       uint `gorm:"primary_key" json:"id"`
+	CartID   uint `gorm:"not null" json:"cart_id"`
+	ItemID   uint `gorm:"not null" json:"item_id"`
+	Quantity int  `gorm:"not null;default:1" json:"quantity"`
+
+	// Item price when units were last added or the quantity was last set,
+	// compared with the current price by Cart.Revalidate. Lines from before
+	// it was recorded have no currency.
+	AddedPrice Money `gorm:"embedded;embedded_prefix:added_price_" json:"added_price"`
+
+	// Computed fields, populated by Cart.ComputeTotals
+	Subtotal *Money `gorm:"-" json:"subtotal,omitempty"`
 
 	// Relationships
 	Cart Cart `gorm:"foreignkey:CartID" json:"cart,omitempty"`
@@ -17,4 +30,3 @@ type CartItem struct {
 func (CartItem) TableName() string {
 	return "cart_items"
 }
-
@@ -0,0 +1,78 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// Access granted on a cart by a share link or to a collaborator
+const (
+	CartAccessView = "view"
+	CartAccessEdit = "edit"
+)
+
+func IsValidCartAccess(access string) bool {
+	return access == CartAccessView || access == CartAccessEdit
+}
+
+// CartShare is a link giving whoever holds its token access to a cart until
+// it expires. Only the digest of the token is stored.
+type CartShare struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	CartID      uint      `gorm:"not null;index" json:"cart_id"`
+	TokenHash   string    `gorm:"type:varchar(64);unique_index;not null" json:"-"`
+	Access      string    `gorm:"not null" json:"access"`
+	CreatedByID uint      `gorm:"not null" json:"created_by_id"`
+	ExpiresAt   time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (CartShare) TableName() string {
+	return "cart_shares"
+}
+
+// CartCollaborator is a user the owner invited to a cart. Collaborators can
+// read the cart and, with edit access, change its lines; only the owner can
+// check it out.
+type CartCollaborator struct {
+	ID          uint      `gorm:"primary_key" json:"id"`
+	CartID      uint      `gorm:"not null;unique_index:idx_cart_collaborator" json:"cart_id"`
+	UserID      uint      `gorm:"not null;unique_index:idx_cart_collaborator" json:"user_id"`
+	Access      string    `gorm:"not null" json:"access"`
+	InvitedByID uint      `gorm:"not null" json:"invited_by_id"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// Relationships
+	User PublicUser `gorm:"foreignkey:UserID" json:"user"`
+}
+
+func (CartCollaborator) TableName() string {
+	return "cart_collaborators"
+}
+
+// Cart change actions
+const (
+	CartChangeAdded   = "added"
+	CartChangeUpdated = "updated"
+	CartChangeRemoved = "removed"
+)
+
+// CartChange records a change to a cart line and who made it: a user, or
+// for edits through a share link the link. ActorID is 0 for edits through a
+// share link, edits to a guest cart, and users who deleted their account.
+// Quantity is the line's quantity after the change.
+type CartChange struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CartID    uint      `gorm:"not null;index" json:"cart_id"`
+	ItemID    uint      `gorm:"not null" json:"item_id"`
+	Action    string    `gorm:"not null" json:"action"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	ActorID   uint      `gorm:"not null" json:"actor_id"`
+	ShareID   *uint     `json:"share_id,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (CartChange) TableName() string {
+	return "cart_changes"
+}
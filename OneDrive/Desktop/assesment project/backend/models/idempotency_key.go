@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// IdempotencyKey stores the first response to a request sent with an
+// Idempotency-Key header so retries can be answered with the same bytes.
+// A StatusCode of zero means the first request is still in progress.
+type IdempotencyKey struct {
+	ID           uint      `gorm:"primary_key" json:"id"`
+	UserID       uint      `gorm:"not null;unique_index:idx_idempotency_keys_user_key" json:"user_id"`
+	Key          string    `gorm:"type:varchar(255);not null;unique_index:idx_idempotency_keys_user_key" json:"key"`
+	RequestHash  string    `gorm:"type:varchar(64);not null" json:"-"`
+	StatusCode   int       `json:"status_code"`
+	ContentType  string    `json:"-"`
+	ResponseBody string    `gorm:"type:text" json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `gorm:"index" json:"expires_at"`
+}
+
+func (IdempotencyKey) TableName() string {
+	return "idempotency_keys"
+}
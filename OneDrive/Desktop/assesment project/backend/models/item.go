@@ -10,8 +10,14 @@ type Item struct {
 	ID        uint      `gorm:"primary_key" json:"id"`
 	Name      string    `gorm:"not null" json:"name"`
 	Status    string    `json:"status"`
+	Price     int64     `gorm:"not null;default:0" json:"price"`
+	Currency  string    `gorm:"type:varchar(3);not null;default:'USD'" json:"currency"`
+	Stock     *int      `json:"stock"`
 	CreatedAt time.Time `json:"created_at"`
 
+	// Computed fields: stock minus active holds, set by the handlers
+	Available *int `gorm:"-" json:"available,omitempty"`
+
 	// Relationships
 	CartItems []CartItem `gorm:"foreignkey:ItemID" json:"-"`
 }
@@ -20,3 +26,31 @@ func (Item) TableName() string {
 	return "items"
 }
 
+// ItemStatusActive is the status of items that can be bought.
+const ItemStatusActive = "active"
+
+// IsActive reports whether the item can be bought.
+func (i Item) IsActive() bool {
+	return i.Status == ItemStatusActive
+}
+
+// UnitPrice returns the item's price as Money.
+func (i Item) UnitPrice() Money {
+	return NewMoney(i.Price, i.Currency)
+}
+
+// TracksStock reports whether the item has an inventory level. Items
+// without one (Stock is nil) can be sold in any quantity.
+func (i Item) TracksStock() bool {
+	return i.Stock != nil
+}
+
+// AvailableStock returns the units that can still be sold: Available when
+// holds have been taken into account, otherwise Stock. Only meaningful when
+// TracksStock is true.
+func (i Item) AvailableStock() int {
+	if i.Available != nil {
+		return *i.Available
+	}
+	return *i.Stock
+}
@@ -10,14 +10,68 @@ type Order struct {
 	ID        uint      `gorm:"primary_key" json:"id"`
 	CartID    uint      `gorm:"not null" json:"cart_id"`
 	UserID    uint      `gorm:"not null" json:"user_id"`
+	Status    string    `gorm:"not null;default:'pending'" json:"status"`
+	Total     Money     `gorm:"embedded;embedded_prefix:total_" json:"total"`
 	CreatedAt time.Time `json:"created_at"`
 
 	// Relationships
-	Cart Cart `gorm:"foreignkey:CartID" json:"cart,omitempty"`
-	User User `gorm:"foreignkey:UserID" json:"user,omitempty"`
+	Lines       []OrderLine       `gorm:"foreignkey:OrderID" json:"lines"`
+	Transitions []OrderTransition `gorm:"foreignkey:OrderID" json:"-"`
+	Cart        Cart              `gorm:"foreignkey:CartID" json:"-"`
+	User        *User             `gorm:"foreignkey:UserID" json:"user,omitempty"`
 }
 
 func (Order) TableName() string {
 	return "orders"
 }
 
+// Order statuses
+const (
+	OrderStatusPending   = "pending"
+	OrderStatusPaid      = "paid"
+	OrderStatusFulfilled = "fulfilled"
+	OrderStatusShipped   = "shipped"
+	OrderStatusDelivered = "delivered"
+	OrderStatusCancelled = "cancelled"
+	OrderStatusRefunded  = "refunded"
+)
+
+// orderTransitions lists the statuses an order may move to from each status.
+// Cancelled and refunded are terminal.
+var orderTransitions = map[string][]string{
+	OrderStatusPending:   {OrderStatusPaid, OrderStatusCancelled},
+	OrderStatusPaid:      {OrderStatusFulfilled, OrderStatusCancelled, OrderStatusRefunded},
+	OrderStatusFulfilled: {OrderStatusShipped, OrderStatusRefunded},
+	OrderStatusShipped:   {OrderStatusDelivered},
+	OrderStatusDelivered: {OrderStatusRefunded},
+	OrderStatusCancelled: {},
+	OrderStatusRefunded:  {},
+}
+
+// IsValidOrderStatus reports whether status is a known order status.
+func IsValidOrderStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// AllowedTransitions returns the statuses the order may move to next.
+func (o Order) AllowedTransitions() []string {
+	return orderTransitions[o.Status]
+}
+
+// CanTransitionTo reports whether the order may move to status.
+func (o Order) CanTransitionTo(status string) bool {
+	for _, next := range orderTransitions[o.Status] {
+		if next == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleasesStock reports whether moving an order to status puts its items
+// back in stock. Both statuses are final, so an order is restocked at most
+// once.
+func ReleasesStock(status string) bool {
+	return status == OrderStatusCancelled || status == OrderStatusRefunded
+}
@@ -0,0 +1,41 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// OrderLine is a snapshot of a cart line taken at checkout. It copies the
+// item's name and price so later catalogue changes do not rewrite history.
+type OrderLine struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	OrderID   uint      `gorm:"not null;index" json:"order_id"`
+	ItemID    uint      `gorm:"not null" json:"item_id"`
+	ItemName  string    `gorm:"not null" json:"item_name"`
+	UnitPrice Money     `gorm:"embedded;embedded_prefix:unit_price_" json:"unit_price"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	LineTotal Money     `gorm:"embedded;embedded_prefix:line_total_" json:"line_total"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (OrderLine) TableName() string {
+	return "order_lines"
+}
+
+// OrderLinesFromCart snapshots the cart's lines. CartItems and their Item
+// must be preloaded.
+func OrderLinesFromCart(cart Cart) []OrderLine {
+	lines := make([]OrderLine, 0, len(cart.CartItems))
+	for _, cartItem := range cart.CartItems {
+		unitPrice := cartItem.Item.UnitPrice()
+		lines = append(lines, OrderLine{
+			ItemID:    cartItem.ItemID,
+			ItemName:  cartItem.Item.Name,
+			UnitPrice: unitPrice,
+			Quantity:  cartItem.Quantity,
+			LineTotal: unitPrice.Mul(cartItem.Quantity),
+		})
+	}
+	return lines
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// OrderTransition records one change of an order's status. The first entry
+// for an order has an empty FromStatus.
+type OrderTransition struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	OrderID    uint      `gorm:"not null;index" json:"order_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `gorm:"not null" json:"to_status"`
+	Note       string    `json:"note,omitempty"`
+	ActorID    uint      `json:"actor_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func (OrderTransition) TableName() string {
+	return "order_transitions"
+}
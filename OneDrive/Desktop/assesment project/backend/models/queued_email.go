@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// QueuedEmail is an email waiting to be delivered by the mail queue worker.
+// It is deleted once sent; Attempts and LastError record failed deliveries.
+type QueuedEmail struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	Recipient string    `gorm:"not null" json:"recipient"`
+	Subject   string    `gorm:"not null" json:"subject"`
+	Body      string    `gorm:"type:text;not null" json:"body"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (QueuedEmail) TableName() string {
+	return "queued_emails"
+}
@@ -0,0 +1,49 @@
+package models
+
+// User roles
+const (
+	RoleCustomer = "customer"
+	RoleStaff    = "staff"
+	RoleAdmin    = "admin"
+)
+
+// Permissions checked by middleware.RequirePermission and the handlers
+const (
+	PermUsersRead     = "users:read"
+	PermUsersManage   = "users:manage"
+	PermItemsWrite    = "items:write"
+	PermCartsReadAll  = "carts:read_all"
+	PermOrdersReadAll = "orders:read_all"
+	PermOrdersManage  = "orders:manage"
+)
+
+var staffPermissions = []string{
+	PermUsersRead,
+	PermCartsReadAll,
+	PermOrdersReadAll,
+	PermOrdersManage,
+}
+
+// rolePermissions lists what each role may do beyond managing its own
+// carts and orders, which every authenticated user can.
+var rolePermissions = map[string][]string{
+	RoleCustomer: {},
+	RoleStaff:    staffPermissions,
+	RoleAdmin:    append([]string{PermUsersManage, PermItemsWrite}, staffPermissions...),
+}
+
+// IsValidRole reports whether role is a known role.
+func IsValidRole(role string) bool {
+	_, ok := rolePermissions[role]
+	return ok
+}
+
+// RoleHasPermission reports whether role grants permission.
+func RoleHasPermission(role, permission string) bool {
+	for _, granted := range rolePermissions[role] {
+		if granted == permission {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// Session is one logged-in device or client. A user can hold any number of
+// sessions at once; each expires independently. Only a digest of the token
+// is stored; the raw token is returned to the client once, at login.
+type Session struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	UserID     uint      `gorm:"not null;index" json:"user_id"`
+	TokenHash  string    `gorm:"type:varchar(64);unique_index" json:"-"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `gorm:"index" json:"expires_at"`
+
+	// Computed fields
+	Current bool `gorm:"-" json:"current"`
+
+	// Relationships
+	User User `gorm:"foreignkey:UserID" json:"-"`
+}
+
+func (Session) TableName() string {
+	return "sessions"
+}
+
+// IsExpired reports whether the session can no longer be used at now.
+func (s Session) IsExpired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt)
+}
+
+// HashSessionToken returns the digest stored for a raw session token.
+// Tokens are 256 random bits, so an unsalted SHA-256 is enough to make a
+// database dump useless for impersonation.
+func HashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,23 @@
+package models
+
+// StockShortage describes a requested quantity that exceeds an item's stock.
+type StockShortage struct {
+	ItemID    uint   `json:"item_id"`
+	ItemName  string `json:"item_name"`
+	Requested int    `json:"requested"`
+	Available int    `json:"available"`
+}
+
+// NewStockShortage reports whether requested exceeds the item's available
+// stock and, if so, describes the shortage.
+func NewStockShortage(item Item, requested int) (StockShortage, bool) {
+	if !item.TracksStock() || requested <= item.AvailableStock() {
+		return StockShortage{}, false
+	}
+	return StockShortage{
+		ItemID:    item.ID,
+		ItemName:  item.Name,
+		Requested: requested,
+		Available: item.AvailableStock(),
+	}, true
+}
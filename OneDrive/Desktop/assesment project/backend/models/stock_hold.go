@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// StockHold keeps Quantity units of an item aside for a cart until
+// ExpiresAt. Holds are only placed when stock holds are enabled.
+type StockHold struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	CartID    uint      `gorm:"not null;unique_index:idx_stock_holds_cart_item" json:"cart_id"`
+	ItemID    uint      `gorm:"not null;unique_index:idx_stock_holds_cart_item;index" json:"item_id"`
+	Quantity  int       `gorm:"not null" json:"quantity"`
+	ExpiresAt time.Time `gorm:"index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (StockHold) TableName() string {
+	return "stock_holds"
+}
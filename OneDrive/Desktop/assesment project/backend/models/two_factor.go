@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// RecoveryCode is a single-use fallback for a user's authenticator. Only
+// the digest of the normalized code is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primary_key" json:"id"`
+	UserID    uint       `gorm:"not null;index" json:"user_id"`
+	CodeHash  string     `gorm:"type:varchar(64);not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+func (RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// LoginChallenge is issued when a password login succeeds for an account
+// with two-factor authentication. Exchanging it with a valid code starts
+// the session.
+type LoginChallenge struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	TokenHash string    `gorm:"type:varchar(64);unique_index;not null" json:"-"`
+	Attempts  int       `gorm:"not null;default:0" json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (LoginChallenge) TableName() string {
+	return "login_challenges"
+}
@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// UsedRefreshToken remembers a refresh token that has already been rotated.
+// Presenting one again means the token leaked, so the whole session is
+// revoked.
+type UsedRefreshToken struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	SessionID uint      `gorm:"not null;index" json:"session_id"`
+	TokenHash string    `gorm:"type:varchar(64);unique_index;not null" json:"-"`
+	UsedAt    time.Time `json:"used_at"`
+}
+
+func (UsedRefreshToken) TableName() string {
+	return "used_refresh_tokens"
+}
@@ -7,20 +7,50 @@ import (
 )
 
 type User struct {
-	ID        uint      `gorm:"primary_key" json:"id"`
-	Username  string    `gorm:"unique;not null" json:"username"`
-	Password  string    `gorm:"not null" json:"-"`
-	Token     *string   `gorm:"type:varchar(255)" json:"-"`
-	CartID    *uint     `json:"cart_id"`
-	CreatedAt time.Time `json:"created_at"`
+	ID          uint      `gorm:"primary_key" json:"id"`
+	Username    string    `gorm:"unique;not null" json:"username"`
+	DisplayName string    `gorm:"type:varchar(100)" json:"display_name"`
+	Email       *string   `gorm:"type:varchar(255);unique_index" json:"email,omitempty"`
+	Password    string    `gorm:"not null" json:"-"`
+	Role        string    `gorm:"not null;default:'customer'" json:"role"`
+	CartID      *uint     `json:"cart_id"`
+	CreatedAt   time.Time `json:"created_at"`
+
+	// Two-factor authentication. The secret is set at enrolment and only
+	// enforced once a first code confirmed it; TOTPLastStep blocks replaying
+	// a code within its validity window.
+	TOTPSecret       string `json:"-"`
+	TwoFactorEnabled bool   `gorm:"not null;default:false" json:"two_factor_enabled"`
+	TOTPLastStep     int64  `gorm:"not null;default:0" json:"-"`
 
 	// Relationships
-	Cart   *Cart    `gorm:"foreignkey:CartID" json:"-"`
-	Carts  []Cart   `gorm:"foreignkey:UserID" json:"-"`
-	Orders []Order  `gorm:"foreignkey:UserID" json:"-"`
+	Cart     *Cart     `gorm:"foreignkey:CartID" json:"-"`
+	Carts    []Cart    `gorm:"foreignkey:UserID" json:"-"`
+	Orders   []Order   `gorm:"foreignkey:UserID" json:"-"`
+	Sessions []Session `gorm:"foreignkey:UserID" json:"-"`
+}
+
+// PublicUser is the part of a user other users may see, such as the owner
+// and collaborators of a shared cart.
+type PublicUser struct {
+	ID          uint   `json:"id"`
+	Username    string `json:"username"`
+	DisplayName string `json:"display_name"`
+}
+
+func (PublicUser) TableName() string {
+	return "users"
 }
 
+// DeletedUserID takes the place of the user ID on orders and other records
+// kept after their owner deleted the account.
+const DeletedUserID = 0
+
 func (User) TableName() string {
 	return "users"
 }
 
+// Can reports whether the user's role grants permission.
+func (u User) Can(permission string) bool {
+	return RoleHasPermission(u.Role, permission)
+}
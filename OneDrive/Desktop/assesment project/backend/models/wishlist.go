@@ -0,0 +1,42 @@
+package models
+
+import (
+	"time"
+
+	_ "github.com/jinzhu/gorm"
+)
+
+// Wishlist is a named list of items a user keeps out of their carts. With
+// Notify set, the user is emailed when a listed item becomes active again
+// or its price drops.
+type Wishlist struct {
+	ID        uint      `gorm:"primary_key" json:"id"`
+	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	Name      string    `gorm:"not null" json:"name"`
+	Notify    bool      `gorm:"not null;default:false" json:"notify"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Relationships
+	Items []WishlistItem `gorm:"foreignkey:WishlistID" json:"items"`
+}
+
+func (Wishlist) TableName() string {
+	return "wishlists"
+}
+
+// WishlistItem is an item on a wishlist. Quantity is kept so an item moved
+// out of a cart goes back with the same quantity.
+type WishlistItem struct {
+	ID         uint      `gorm:"primary_key" json:"id"`
+	WishlistID uint      `gorm:"not null;index" json:"wishlist_id"`
+	ItemID     uint      `gorm:"not null;index" json:"item_id"`
+	Quantity   int       `gorm:"not null;default:1" json:"quantity"`
+	CreatedAt  time.Time `json:"created_at"`
+
+	// Relationships
+	Item Item `gorm:"foreignkey:ItemID" json:"item,omitempty"`
+}
+
+func (WishlistItem) TableName() string {
+	return "wishlist_items"
+}